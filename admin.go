@@ -0,0 +1,85 @@
+package jwt_middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/agilezebra/jwt-middleware/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// minAdminSecretLength is the minimum length of the adminSecret, as the admin endpoint can change who is authorized.
+const minAdminSecretLength = 32
+
+// maxAdminBodySize is the maximum size of a require block POSTed to the admin endpoint.
+const maxAdminBodySize = 1 << 20
+
+// SetRequire validates and then replaces the inline require configuration, recombining it with any requireFile and
+// optionalClaims as at startup. The current requirements are kept if the new ones are invalid. An empty require is
+// rejected, as it would allow any validly signed token. The change lasts until the plugin is recreated by traefik.
+func (plugin *JWTPlugin) SetRequire(inline map[string]any) (err error) {
+	if len(inline) == 0 {
+		return fmt.Errorf("require must not be empty")
+	}
+
+	// NewRequirement panics on bad configuration, which mustn't take down the server
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("invalid require: %v", recovered)
+		}
+	}()
+	require, err := newRequire(inline, plugin.requireFile, plugin.optionalClaims)
+	if err != nil {
+		return err
+	}
+
+	plugin.requireLock.Lock()
+	defer plugin.requireLock.Unlock()
+	plugin.requireInline = inline
+	plugin.require = require
+	plugin.requireTemplates = usesTemplates(require)
+	plugin.invalidateDecisions()
+	return nil
+}
+
+// serveAdmin handles requests to the adminPath, which must be POSTs of a new require block as JSON or YAML,
+// authorized with the adminSecret as a Bearer token.
+func (plugin *JWTPlugin) serveAdmin(response http.ResponseWriter, request *http.Request) {
+	secret, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(secret), plugin.adminSecret) != 1 {
+		http.Error(response, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if request.Method != http.MethodPost {
+		response.Header().Set("Allow", http.MethodPost)
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxAdminBodySize+1))
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxAdminBodySize {
+		http.Error(response, "require is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var require map[string]any
+	err = yaml.Unmarshal(body, &require) // YAML is a superset of JSON, so this handles both
+	if err != nil {
+		http.Error(response, fmt.Sprintf("failed to parse require: %v", err), http.StatusBadRequest)
+		return
+	}
+	err = plugin.SetRequire(require)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.Log("WARN", "require replaced by admin request from %s", request.RemoteAddr)
+	response.WriteHeader(http.StatusNoContent)
+}
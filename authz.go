@@ -0,0 +1,150 @@
+package jwt_middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthzRequest is the payload POSTed to the external authorization decision service.
+type AuthzRequest struct {
+	Claims  map[string]any    `json:"claims"`
+	Request map[string]string `json:"request"`
+}
+
+// AuthzDecision is the response expected from the external authorization decision service.
+type AuthzDecision struct {
+	Allow bool `json:"allow"`
+}
+
+// authzCacheEntry is a cached decision from the external authorization decision service.
+type authzCacheEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// authzCache is a short-lived cache of external authorization decisions keyed by issuer, subject, method and path.
+type authzCache struct {
+	lock      sync.Mutex
+	entries   map[string]authzCacheEntry
+	duration  time.Duration
+	sweepSize int // The size at which we sweep expired entries on insertion
+}
+
+// FetchAuthzDecision POSTs the request to the given URL and returns the decision.
+func FetchAuthzDecision(url string, client *http.Client, request AuthzRequest) (*AuthzDecision, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", response.StatusCode, url)
+	}
+	var decision AuthzDecision
+	err = json.NewDecoder(response.Body).Decode(&decision)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+
+	return &decision, nil
+}
+
+// newAuthzCache creates a decision cache holding entries for the given duration, or nil if the duration is 0.
+func newAuthzCache(duration time.Duration) *authzCache {
+	if duration == 0 {
+		return nil
+	}
+	return &authzCache{entries: make(map[string]authzCacheEntry), duration: duration, sweepSize: 1024}
+}
+
+// get returns the cached decision for key and whether there was an unexpired entry.
+func (cache *authzCache) get(key string) (bool, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.allow, true
+}
+
+// set caches the decision for key, sweeping out any expired entries if the cache has grown large.
+func (cache *authzCache) set(key string, allow bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	if len(cache.entries) >= cache.sweepSize {
+		for key, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	cache.entries[key] = authzCacheEntry{allow: allow, expires: now.Add(cache.duration)}
+}
+
+// authorize asks the external authorization decision service, if configured, whether the request with the given claims is allowed.
+// The request described, and by which decisions are cached with the issuer and subject, is the original request in forwardAuthMode.
+// If the service can't be reached, the request is allowed only if authzFailOpen is set.
+func (plugin *JWTPlugin) authorize(claims map[string]any, variables *TemplateVariables) error {
+	if plugin.authzURL == "" {
+		return nil
+	}
+
+	target := map[string]string{
+		"method": (*variables)["Method"],
+		"scheme": (*variables)["Scheme"],
+		"host":   (*variables)["Host"],
+		"path":   (*variables)["Path"],
+		"url":    (*variables)["URL"],
+	}
+	if plugin.forwardAuthMode {
+		// The template variables are those of traefik's request to us, which is the same for every route
+		for _, attribute := range []string{"method", "scheme", "host", "path", "url"} {
+			target[attribute] = (*variables)[requestPrefix+attribute]
+		}
+	}
+
+	// We can only cache decisions for tokens that identify their subject, which is only unique within its issuer
+	key := ""
+	if subject, ok := claims["sub"].(string); ok && plugin.authzCache != nil {
+		issuer, _ := claims["iss"].(string)
+		key = strings.Join([]string{issuer, subject, target["method"], target["host"], target["path"]}, "\x00")
+		if allow, ok := plugin.authzCache.get(key); ok {
+			return authzError(allow)
+		}
+	}
+
+	request := AuthzRequest{Claims: claims, Request: target}
+	decision, err := FetchAuthzDecision(plugin.authzURL, plugin.authzClient, request)
+	if err != nil {
+		requestLog(variables, "ERROR", "failed to fetch authorization decision from %s: %v", plugin.authzURL, err)
+		if plugin.authzFailOpen {
+			return nil
+		}
+		return fmt.Errorf("authorization decision unavailable")
+	}
+
+	if key != "" {
+		plugin.authzCache.set(key, decision.Allow)
+	}
+	return authzError(decision.Allow)
+}
+
+// authzError returns an error if the decision was to deny.
+func authzError(allow bool) error {
+	if allow {
+		return nil
+	}
+	return fmt.Errorf("denied by authorization decision")
+}
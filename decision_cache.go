@@ -0,0 +1,129 @@
+package jwt_middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultDecisionCacheSize is the number of decisions held by the decision cache unless decisionCacheSize is set.
+const defaultDecisionCacheSize = 1024
+
+// cachedDecision is the result of validating a token for a request: the claims to map to headers if it was allowed,
+// or the status and error if it was denied.
+type cachedDecision struct {
+	key     string
+	status  int
+	err     error
+	claims  jwt.MapClaims // The claims, if allowed
+	raw     string        // The raw token, if allowed, for forwardTokenHeader
+	expires time.Time
+}
+
+// decisionCache is a bounded LRU cache of the decisions for tokens that have been fully validated, so that a hot endpoint
+// presented with the same token over and over doesn't verify its signature and evaluate its requirements every time.
+type decisionCache struct {
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // Of *cachedDecision, the most recently used first
+	duration time.Duration
+	size     int
+}
+
+// newDecisionCache creates a cache holding up to size decisions for the given duration, or nil if the duration is 0.
+func newDecisionCache(duration time.Duration, size int) *decisionCache {
+	if duration == 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultDecisionCacheSize
+	}
+	return &decisionCache{entries: make(map[string]*list.Element), order: list.New(), duration: duration, size: size}
+}
+
+// decisionCacheKey returns the cache key for the token presented with the request. As well as the token, it covers all that
+// the decision may depend upon from the request: the template variables derived from it and the route it is for. The
+// route is that of $request., as in forwardAuthMode the request's own method and URL are the same for every route.
+func decisionCacheKey(token string, variables *TemplateVariables) string {
+	hash := sha256.New()
+	parts := []string{token, (*variables)["Method"], (*variables)["URL"], (*variables)["Language"],
+		(*variables)[requestPrefix+"method"], (*variables)[requestPrefix+"url"]}
+	for _, part := range parts {
+		hash.Write([]byte(part)) //nolint:errcheck
+		hash.Write([]byte{0})    //nolint:errcheck
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the unexpired decision for key, if any.
+func (cache *decisionCache) get(key string) (*cachedDecision, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	decision := element.Value.(*cachedDecision)
+	if !time.Now().Before(decision.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return decision, true
+}
+
+// set caches the decision for key until the cache duration has elapsed or the token expires, whichever is sooner,
+// evicting the least recently used decision if the cache is full.
+func (cache *decisionCache) set(key string, decision *cachedDecision, expiry *jwt.NumericDate) {
+	decision.key = key
+	decision.expires = time.Now().Add(cache.duration)
+	if expiry != nil && expiry.Before(decision.expires) {
+		decision.expires = expiry.Time
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value = decision
+		cache.order.MoveToFront(element)
+		return
+	}
+	if cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedDecision).key)
+	}
+	cache.entries[key] = cache.order.PushFront(decision)
+}
+
+// clear removes all decisions, as when the requirements, keys or revocations they were made with change.
+func (cache *decisionCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+}
+
+// invalidateDecisions clears the decision cache, if enabled.
+func (plugin *JWTPlugin) invalidateDecisions() {
+	if plugin.decisionCache != nil {
+		plugin.decisionCache.clear()
+	}
+}
+
+// applyDecision returns a cached decision for the request, mapping the claims to headers if it was allowed, as validate does.
+func (plugin *JWTPlugin) applyDecision(decision *cachedDecision, headers http.Header) (int, error) {
+	if decision.claims == nil {
+		return decision.status, decision.err
+	}
+	plugin.mapClaimsToHeaders(decision.claims, headers)
+	if plugin.forwardTokenHeader != "" {
+		headers.Set(plugin.forwardTokenHeader, decision.raw)
+	}
+	return http.StatusOK, nil
+}
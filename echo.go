@@ -0,0 +1,45 @@
+package jwt_middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// serveEchoClaims handles requests to the echoClaimsPath, responding with the decoded claims of the request's token as JSON,
+// so that integrators can see what their tokens contain. The token must be valid, as for any other request, so that
+// the endpoint can't be used as an oracle for tokens that would be refused.
+func (plugin *JWTPlugin) serveEchoClaims(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Cache-Control", "no-store")
+	tokens, err := plugin.extractTokens(request)
+	if err == nil && len(tokens) == 0 {
+		err = errNoToken
+	}
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	variables := plugin.NewTemplateVariables(request)
+	// As for any other request, the first valid token is used, otherwise the first's failure is reported
+	var parsed *jwt.Token
+	status, err := validateTokens(tokens, variables, func(token string, variables *TemplateVariables) (int, error) {
+		status, validated, err := plugin.validateToken(request, token, http.Header{}, variables)
+		if err == nil {
+			parsed = validated
+		}
+		return status, err
+	})
+	if err != nil {
+		http.Error(response, err.Error(), status)
+		return
+	}
+
+	body, err := json.Marshal(parsed.Claims)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(body) //nolint:errcheck
+}
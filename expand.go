@@ -0,0 +1,109 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// environmentReference matches a ${NAME} reference to an environment variable. The bare $NAME form isn't expanded so that
+// secrets and templates containing a $ are left alone.
+var environmentReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvironment replaces the ${NAME} references in value with the named environment variable, returning an error
+// naming the first that isn't set, as an empty secret or issuer is never what was intended. PEM blocks are returned unchanged.
+func expandEnvironment(value string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return value, nil
+	}
+	unset := ""
+	expanded := environmentReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := reference[2 : len(reference)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && unset == "" {
+			unset = name
+		}
+		return value
+	})
+	if unset != "" {
+		return value, fmt.Errorf("environment variable %s is not set", unset)
+	}
+	return expanded, nil
+}
+
+// expandConfig expands the environment references in all string fields of the config, including the strings within its
+// lists, maps (e.g. issuers and require) and nested structs (e.g. derivedSecret), in place.
+func expandConfig(config *Config) error {
+	return expandFields(reflect.ValueOf(config).Elem())
+}
+
+// expandFields expands the environment references in the string fields of the struct, recursing into pointers to structs.
+func expandFields(fields reflect.Value) error {
+	for index := 0; index < fields.NumField(); index++ {
+		field := fields.Field(index)
+		switch value := field.Interface().(type) {
+		case string:
+			expanded, err := expandEnvironment(value)
+			if err != nil {
+				return err
+			}
+			field.SetString(expanded)
+		case []string:
+			for item := range value {
+				expanded, err := expandEnvironment(value[item])
+				if err != nil {
+					return err
+				}
+				value[item] = expanded
+			}
+		case map[string]string:
+			for key, item := range value {
+				expanded, err := expandEnvironment(item)
+				if err != nil {
+					return err
+				}
+				value[key] = expanded
+			}
+		case []any, map[string]any:
+			_, err := expandValue(value)
+			if err != nil {
+				return err
+			}
+		default:
+			if field.Kind() == reflect.Pointer && !field.IsNil() && field.Elem().Kind() == reflect.Struct {
+				err := expandFields(field.Elem())
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expandValue expands the environment references in a value decoded from the configuration, recursing into lists and maps.
+func expandValue(value any) (any, error) {
+	switch value := value.(type) {
+	case string:
+		return expandEnvironment(value)
+	case []any:
+		for index, item := range value {
+			expanded, err := expandValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[index] = expanded
+		}
+	case map[string]any:
+		for key, item := range value {
+			expanded, err := expandValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = expanded
+		}
+	}
+	return value, nil
+}
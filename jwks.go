@@ -7,13 +7,17 @@ import (
 	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"strings"
+
+	"github.com/agilezebra/jwt-middleware/logger"
 )
 
 // JSONWebKey is a JSON web key returned by the JWKS request.
@@ -38,14 +42,46 @@ type JSONWebKey struct {
 	Crv string   `json:"crv,omitempty"`
 }
 
+// UnmarshalJSON unmarshals the JSON web key, accepting a kid given as a JSON number (as emitted by some non-compliant issuers).
+// The number is formatted by keyID, exactly as a numeric kid in a token header is, so that the two are indexed consistently.
+func (jwk *JSONWebKey) UnmarshalJSON(data []byte) error {
+	type plain JSONWebKey // Without this method, so that unmarshalling it doesn't recurse
+	var key struct {
+		plain
+		Kid json.RawMessage `json:"kid"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return err
+	}
+	*jwk = JSONWebKey(key.plain)
+	if len(key.Kid) == 0 || string(key.Kid) == "null" {
+		return nil
+	}
+	if key.Kid[0] == '"' {
+		return json.Unmarshal(key.Kid, &jwk.Kid)
+	}
+	var number float64
+	if err := json.Unmarshal(key.Kid, &number); err != nil {
+		return fmt.Errorf("kid must be a string or number: %v", err)
+	}
+	jwk.Kid, _ = keyID(number)
+	return nil
+}
+
 // JSONWebKeySet represents a set of JSON web keys.
 type JSONWebKeySet struct {
 	Keys []JSONWebKey `json:"keys"`
 }
 
 // FetchJWKS fetches the JSON web keys from the given URL and returns a map kid -> key.
+// Any keys that include private parameters are never used.
 func FetchJWKS(url string, client *http.Client) (map[string]any, error) {
-	response, err := client.Get(url)
+	return FetchJWKSWithOptions(url, client, FetchOptions{})
+}
+
+// FetchJWKSWithOptions fetches the JSON web keys from the given URL with the given options and returns a map kid -> key.
+func FetchJWKSWithOptions(url string, client *http.Client, options FetchOptions) (map[string]any, error) {
+	response, err := fetch(url, client, options.UserAgent)
 	if err != nil {
 		return nil, err
 	}
@@ -55,13 +91,34 @@ func FetchJWKS(url string, client *http.Client) (map[string]any, error) {
 	}
 
 	var jwks JSONWebKeySet
-	err = json.NewDecoder(response.Body).Decode(&jwks)
+	err = decodeLimited(response, url, options.maxBytes(), &jwks)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", url, err)
+		return nil, err
 	}
+	return jwksKeys(jwks, url, options.RejectPrivate)
+}
+
+// jwksKeys converts the JSON web keys from the given source (a URL or the configuration) to a map kid -> key.
+func jwksKeys(jwks JSONWebKeySet, url string, rejectPrivate bool) (map[string]any, error) {
 	keys := make(map[string]any, len(jwks.Keys))
 	for _, jwk := range jwks.Keys {
-		if jwk.Kid == "" {
+		if jwk.isPrivate() {
+			if rejectPrivate {
+				return nil, fmt.Errorf("%s: kid %s includes private key parameters", url, jwk.Kid)
+			}
+			logger.Log("WARN", "ignoring kid:%s from url:%s as it includes private key parameters", jwk.Kid, url)
+			continue
+		}
+		if len(jwk.X5c) > 0 && jwk.N == "" && jwk.X == "" {
+			// The key is given only by its certificate chain
+			err := jwk.setFromCertificate()
+			if err != nil {
+				logger.Log("WARN", "ignoring kid:%s from url:%s: invalid x5c: %v", jwk.Kid, url, err)
+				continue
+			}
+		}
+		kidless := jwk.Kid == ""
+		if kidless {
 			jwk.Kid = JWKThumbprint(jwk)
 		}
 		switch jwk.Kty {
@@ -119,11 +176,127 @@ func FetchJWKS(url string, client *http.Client) (map[string]any, error) {
 				}
 			}
 		}
+		// Tokens for keys without a kid may instead reference the key by its certificate thumbprint
+		if key, ok := keys[jwk.Kid]; ok && kidless && jwk.X5t != "" {
+			keys[jwk.X5t] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// ParseJWKS parses a JSON web key set document, as given in the inlineJWKS configuration, and returns a map kid -> key.
+// Private keys are never accepted.
+func ParseJWKS(content []byte) (map[string]any, error) {
+	var jwks JSONWebKeySet
+	err := json.Unmarshal(content, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := jwksKeys(jwks, "inlineJWKS", true)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
+
+// The formats of the keys served by an issuer's hard-coded endpoint.
+const (
+	keysFormatJWKS = "jwks" // A standard JSON web key set
+	keysFormatPEM  = "pem"  // A JSON object of kid -> PEM certificate or public key, as served by Google for Firebase
+)
+
+// FetchPEMKeys fetches the Firebase-style JSON object of kid -> PEM-encoded certificate (or public key) from the given URL
+// and returns a map kid -> key.
+func FetchPEMKeys(url string, client *http.Client) (map[string]any, error) {
+	return FetchPEMKeysWithOptions(url, client, FetchOptions{})
+}
+
+// FetchPEMKeysWithOptions fetches the keys from the given URL, as FetchPEMKeys does, with the given options.
+func FetchPEMKeysWithOptions(url string, client *http.Client, options FetchOptions) (map[string]any, error) {
+	response, err := fetch(url, client, options.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", response.StatusCode, url)
 	}
 
+	var certificates map[string]string
+	err = decodeLimited(response, url, options.maxBytes(), &certificates)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(certificates))
+	for kid, encoded := range certificates {
+		key, err := pemPublicKey(encoded)
+		if err != nil {
+			logger.Log("WARN", "ignoring kid:%s from url:%s: %v", kid, url, err)
+			continue
+		}
+		keys[kid] = key
+	}
 	return keys, nil
 }
 
+// pemPublicKey returns the public key from a PEM-encoded certificate or public key.
+func pemPublicKey(encoded string) (any, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("malformed PEM")
+	}
+	if block.Type != "CERTIFICATE" {
+		return setupKey(encoded, false)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := certificate.PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported certificate key type %T", key)
+	}
+}
+
+// setFromCertificate sets the JWK's key parameters from the public key of its leaf (first) x5c certificate.
+// For EC keys, the curve is that of the certificate's key, as the JWK may not specify crv.
+func (jwk *JSONWebKey) setFromCertificate() error {
+	der, err := base64.StdEncoding.DecodeString(jwk.X5c[0])
+	if err != nil {
+		return err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	switch key := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = key.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	default:
+		return fmt.Errorf("unsupported certificate key type %T", key)
+	}
+	return nil
+}
+
+// isPrivate returns true if the JWK includes any private key parameters, which an issuer should never publish.
+func (jwk JSONWebKey) isPrivate() bool {
+	return jwk.D != "" || jwk.P != "" || jwk.Q != "" || jwk.Dp != "" || jwk.Dq != "" || jwk.Qi != ""
+}
+
 // JWKThumbprint creates a JWK thumbprint out of pub
 // as specified in https://tools.ietf.org/html/rfc7638.
 func JWKThumbprint(jwk JSONWebKey) string {
@@ -3,17 +3,30 @@ package jwt_middleware
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"html"
 	"html/template"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,65 +34,270 @@ import (
 	"github.com/agilezebra/jwt-middleware/logger"
 	"github.com/danwakefield/fnmatch"
 	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
 )
 
 // Config is the configuration for the plugin.
 type Config struct {
-	ValidMethods           []string          `json:"validMethods,omitempty"`
-	Issuers                []any             `json:"issuers,omitempty"`
-	SkipPrefetch           bool              `json:"skipPrefetch,omitempty"`
-	DelayPrefetch          string            `json:"delayPrefetch,omitempty"`
-	RefreshKeysInterval    string            `json:"refreshKeysInterval,omitempty"`
-	InsecureSkipVerify     []string          `json:"insecureSkipVerify,omitempty"`
-	RootCAs                []string          `json:"rootCAs,omitempty"`
-	Secret                 string            `json:"secret,omitempty"`
-	Secrets                map[string]string `json:"secrets,omitempty"`
-	SecretBase64Encoded    bool              `json:"secretBase64Encoded,omitempty"`
-	Require                map[string]any    `json:"require,omitempty"`
-	Optional               bool              `json:"optional,omitempty"`
-	UnauthenticatedMethods []string          `json:"unauthenticatedMethods,omitempty"`
-	RedirectUnauthorized   string            `json:"redirectUnauthorized,omitempty"`
-	RedirectForbidden      string            `json:"redirectForbidden,omitempty"`
-	CookieName             string            `json:"cookieName,omitempty"`
-	HeaderName             string            `json:"headerName,omitempty"`
-	ParameterName          string            `json:"parameterName,omitempty"`
-	HeaderMap              map[string]string `json:"headerMap,omitempty"`
-	RemoveMissingHeaders   bool              `json:"removeMissingHeaders,omitempty"`
-	ForwardToken           bool              `json:"forwardToken,omitempty"`
-	Freshness              int64             `json:"freshness,omitempty"`
-	LogUnauthorized        string            `json:"logUnauthorized,omitempty"`
+	ValidMethods              []string          `json:"validMethods,omitempty"`
+	Issuers                   []any             `json:"issuers,omitempty"`
+	SkipPrefetch              bool              `json:"skipPrefetch,omitempty"`
+	DelayPrefetch             string            `json:"delayPrefetch,omitempty"`
+	RefreshKeysInterval       string            `json:"refreshKeysInterval,omitempty"`
+	InsecureSkipVerify        []string          `json:"insecureSkipVerify,omitempty"`
+	RootCAs                   []string          `json:"rootCAs,omitempty"`
+	Secret                    string            `json:"secret,omitempty"`
+	Secrets                   map[string]string `json:"secrets,omitempty"`
+	SecretBase64Encoded       bool              `json:"secretBase64Encoded,omitempty"`
+	Require                   map[string]any    `json:"require,omitempty"`
+	RequireFile               string            `json:"requireFile,omitempty"`
+	Optional                  bool              `json:"optional,omitempty"`
+	UnauthenticatedMethods    []string          `json:"unauthenticatedMethods,omitempty"`
+	RedirectUnauthorized      string            `json:"redirectUnauthorized,omitempty"`
+	RedirectForbidden         string            `json:"redirectForbidden,omitempty"`
+	CookieName                string            `json:"cookieName,omitempty"`
+	HeaderName                string            `json:"headerName,omitempty"`
+	ParameterName             string            `json:"parameterName,omitempty"`
+	HeaderMap                 map[string]string `json:"headerMap,omitempty"`
+	RemoveMissingHeaders      bool              `json:"removeMissingHeaders,omitempty"`
+	ForwardToken              bool              `json:"forwardToken,omitempty"`
+	Freshness                 int64             `json:"freshness,omitempty"`
+	FreshnessDuration         string            `json:"freshnessDuration,omitempty"`
+	LogUnauthorized           string            `json:"logUnauthorized,omitempty"`
+	DenialReasonHeader        string            `json:"denialReasonHeader,omitempty"`
+	ForwardTokenHeader        string            `json:"forwardTokenHeader,omitempty"`
+	SplitClaims               map[string]string `json:"splitClaims,omitempty"`
+	AuthzURL                  string            `json:"authzURL,omitempty"`
+	AuthzFailOpen             bool              `json:"authzFailOpen,omitempty"`
+	AuthzCacheDuration        string            `json:"authzCacheDuration,omitempty"`
+	AuthzTimeout              string            `json:"authzTimeout,omitempty"`
+	MaxConcurrentValidations  int               `json:"maxConcurrentValidations,omitempty"`
+	RequireHeader             map[string]any    `json:"requireHeader,omitempty"`
+	UserClaim                 string            `json:"userClaim,omitempty"`
+	UserHeader                string            `json:"userHeader,omitempty"`
+	EmailClaim                string            `json:"emailClaim,omitempty"`
+	EmailHeader               string            `json:"emailHeader,omitempty"`
+	ForwardAuthMode           bool              `json:"forwardAuthMode,omitempty"`
+	SetHeaders                map[string]string `json:"setHeaders,omitempty"`
+	SecretsBundle             string            `json:"secretsBundle,omitempty"`
+	RequestIDHeader           string            `json:"requestIDHeader,omitempty"`
+	OpenIDConfigPath          string            `json:"openidConfigPath,omitempty"`
+	JWKSPath                  string            `json:"jwksPath,omitempty"`
+	RequireNonEmpty           bool              `json:"requireNonEmpty,omitempty"`
+	LenientTimeClaims         bool              `json:"lenientTimeClaims,omitempty"`
+	MaxFutureIat              string            `json:"maxFutureIat,omitempty"`
+	RejectPrivateJWKS         bool              `json:"rejectPrivateJWKS,omitempty"`
+	KeyRetention              string            `json:"keyRetention,omitempty"`
+	RefreshHeader             string            `json:"refreshHeader,omitempty"`
+	InlineJWKS                string            `json:"inlineJWKS,omitempty"`
+	HostAudience              map[string]string `json:"hostAudience,omitempty"`
+	RequireScopes             []string          `json:"requireScopes,omitempty"`
+	ScopeClaims               []string          `json:"scopeClaims,omitempty"`
+	RefetchOnSignatureFailure bool              `json:"refetchOnSignatureFailure,omitempty"`
+	DefaultIssuer             string            `json:"defaultIssuer,omitempty"`
+	DiscoveryTTL              string            `json:"discoveryTTL,omitempty"`
+	IgnoredSchemes            []string          `json:"ignoredSchemes,omitempty"`
+	CoerceBooleans            bool              `json:"coerceBooleans,omitempty"`
+	SignHeaders               string            `json:"signHeaders,omitempty"`
+	StripAllTokenSources      bool              `json:"stripAllTokenSources,omitempty"`
+	FailOpenPaths             []string          `json:"failOpenPaths,omitempty"`
+	CacheControl              string            `json:"cacheControl,omitempty"`
+	GRPCDetection             string            `json:"grpcDetection,omitempty"`
+	MinRSABits                int               `json:"minRSABits,omitempty"`
+	NormalizeKid              bool              `json:"normalizeKid,omitempty"`
+	SubjectHeader             string            `json:"subjectHeader,omitempty"`
+	SubjectClaims             []string          `json:"subjectClaims,omitempty"`
+	UnknownKidTTL             string            `json:"unknownKidTTL,omitempty"`
+	ExactAudience             bool              `json:"exactAudience,omitempty"`
+	RequireTLSIssuers         bool              `json:"requireTLSIssuers,omitempty"`
+	ReportAllFailures         bool              `json:"reportAllFailures,omitempty"`
+	StateSecret               string            `json:"stateSecret,omitempty"`
+	StateMaxAge               string            `json:"stateMaxAge,omitempty"`
+	WebsocketProtocolToken    bool              `json:"websocketProtocolToken,omitempty"`
+	WebsocketProtocolPrefix   string            `json:"websocketProtocolPrefix,omitempty"`
+	ClientCertBypass          []string          `json:"clientCertBypass,omitempty"`
+	UserAgent                 string            `json:"userAgent,omitempty"`
+	ClearCookieOnUnauthorized bool              `json:"clearCookieOnUnauthorized,omitempty"`
+	CookieDomain              string            `json:"cookieDomain,omitempty"`
+	CookiePath                string            `json:"cookiePath,omitempty"`
+	CookieSecure              bool              `json:"cookieSecure,omitempty"`
+	CookieHTTPOnly            bool              `json:"cookieHttpOnly,omitempty"`
+	CookieSameSite            string            `json:"cookieSameSite,omitempty"`
+	ParameterNames            []string          `json:"parameterNames,omitempty"`
+	OptionalClaims            []string          `json:"optionalClaims,omitempty"`
+	AdminPath                 string            `json:"adminPath,omitempty"`
+	AdminSecret               string            `json:"adminSecret,omitempty"`
+	OptionalMethods           []string          `json:"optionalMethods,omitempty"`
+	RequireSubject            bool              `json:"requireSubject,omitempty"`
+	LazyIssuers               bool              `json:"lazyIssuers,omitempty"`
+	RevocationURL             string            `json:"revocationURL,omitempty"`
+	RevocationFailOpen        bool              `json:"revocationFailOpen,omitempty"`
+	FetchTimeout              string            `json:"fetchTimeout,omitempty"`
+	CircuitBreakerThreshold   int               `json:"circuitBreakerThreshold,omitempty"`
+	CircuitBreakerCooldown    string            `json:"circuitBreakerCooldown,omitempty"`
+	RenameTokenHeader         string            `json:"renameTokenHeader,omitempty"`
+	NotYetValidStatus         int               `json:"notYetValidStatus,omitempty"`
+	RouteRequire              []any             `json:"routeRequire,omitempty"`
+	MaxTokenLifetime          string            `json:"maxTokenLifetime,omitempty"`
+	RequireLifetimeClaims     bool              `json:"requireLifetimeClaims,omitempty"`
+	DecisionCacheDuration     string            `json:"decisionCacheDuration,omitempty"`
+	DecisionCacheSize         int               `json:"decisionCacheSize,omitempty"`
+	StrictConfig              bool              `json:"strictConfig,omitempty"`
+	Unknown                   map[string]any    `json:"-" mapstructure:",remain"` // Any keys not matching a field above, as collected by traefik's decoder
+	ClaimsPath                string            `json:"claimsPath,omitempty"`
+	EchoClaimsPath            string            `json:"echoClaimsPath,omitempty"`
+	MultipleHeaderValues      string            `json:"multipleHeaderValues,omitempty"`
+	MaxJWKSBytes              int               `json:"maxJWKSBytes,omitempty"`
+	DerivedSecret             *DerivedSecret    `json:"derivedSecret,omitempty"`
 }
 
+// defaultUserAgent is the User-Agent of requests to issuers unless userAgent is configured, rather than Go's default which some WAFs block.
+const defaultUserAgent = "jwt-middleware (+https://github.com/agilezebra/jwt-middleware)"
+
+
+// wildcardKid is the kid in secrets that matches any kid not otherwise matched.
+const wildcardKid = "*"
+
+// wildcardHost is the host in the clients map for the client to use for all hosts.
+const wildcardHost = "*"
+
+// internalIssuer is the pseudo-issuer in issuerKeys for keys configured in secrets.
+const internalIssuer = "internal"
+
+// stateCookieName is the name of the cookie that binds the State template variable to the browser it was issued to.
+const stateCookieName = "jwt-middleware-state"
+
+// errNoToken is returned by validate when no token is present in the request.
+var errNoToken = errors.New("no token provided")
+
+// errMultipleTokens is returned by validate when the token header has multiple values and multipleHeaderValues is reject.
+var errMultipleTokens = errors.New("multiple token header values provided")
+
+// ErrAlgNone is returned by validate for an unsigned token with alg none, which is always rejected as an attempted downgrade.
+var ErrAlgNone = errors.New("token with alg none is not accepted")
+
 // CaseInsensitiveSet is a set of strings that can be checked for membership in a case-insensitive manner.
 type CaseInsensitiveSet map[string]struct{}
 
 // JWTPlugin is a traefik middleware plugin that authorizes access based on JWT tokens.
 type JWTPlugin struct {
-	next                   http.Handler              // The next http.Handler in the chain
-	name                   string                    // The name of the plugin
-	parser                 *jwt.Parser               // A JWT parser instance, which we use for all token parsing
-	secret                 any                       // A single anonymous fixed public key or HMAC secret, or nil
-	issuers                []string                  // A list of valid issuers that we trust to fetch keys from
-	issuerJWKSEndpoints    map[string]string         // A map of issuer URLs to hard-coded JWKS endpoints (for non-standard issuers)
-	clients                map[string]*http.Client   // A map of clients for specific issuers that skip certificate verification
-	defaultClient          *http.Client              // A default client for fetching keys with certificate verification, optionally with custom root CAs
-	require                Requirement               // A map of requirements for each claim (which we treat simply as a Requirement to be validated)
-	lock                   sync.RWMutex              // Read-write lock for the keys and issuerKeys maps
-	keys                   map[string]any            // A map of key IDs to public keys or shared HMAC secrets
-	issuerKeys             map[string]map[string]any // A map of issuer URLs to key IDs to public keys, for reference counting / purging
-	optional               bool                      // If true, requests without a token are allowed but any token provided must still be valid
-	unauthenticatedMethods CaseInsensitiveSet        // A set of HTTP methods that bypass authentication entirely
-	redirectUnauthorized   *template.Template        // A template for redirecting unauthorized requests
-	redirectForbidden      *template.Template        // A template for redirecting forbidden requests
-	cookieName             string                    // The name of the cookie to extract the token from
-	headerName             string                    // The name of the header to extract the token from
-	parameterName          string                    // The name of the query parameter to extract the token from
-	headerMap              map[string]string         // A map of claim names to header names to forward to the backend
-	removeMissingHeaders   bool                      // If true, remove missing headers from the request
-	forwardToken           bool                      // If true, the token is forwarded to the backend
-	freshness              int64                     // The maximum age of a token in seconds
-	environment            map[string]string         // Map of environment variables
-	logUnauthorized        string                    // If set, log the details of the failed requirements to the level specified
+	next                      http.Handler                    // The next http.Handler in the chain
+	name                      string                          // The name of the plugin
+	parser                    *jwt.Parser                     // A JWT parser instance, which we use for all token parsing
+	secret                    any                             // A single anonymous fixed public key or HMAC secret, or nil
+	wildcardSecret            any                             // A public key or HMAC secret from secrets to use for any kid not otherwise matched, or nil
+	issuers                   []string                        // A list of valid issuers that we trust to fetch keys from
+	issuerJWKSEndpoints       map[string]string               // A map of issuer URLs to hard-coded JWKS endpoints (for non-standard issuers)
+	issuerKeyFormats          map[string]string               // A map of issuer URLs to the format of their hard-coded endpoints, if not JWKS
+	issuerAdditionalJWKS      map[string][]string             // A map of issuer URLs to any further endpoints whose keys are merged with the issuer's own
+	clients                   map[string]*http.Client         // A map of clients for specific issuers that skip certificate verification
+	defaultClient             *http.Client                    // A default client for fetching keys with certificate verification, optionally with custom root CAs
+	require                   Requirement                     // A map of requirements for each claim (which we treat simply as a Requirement to be validated)
+	requireInline             map[string]any                  // The inline require configuration, kept to recombine with requireFile on reload
+	requireFile               string                          // If set, a YAML or JSON file of additional requirements, reloaded with the keys
+	requireLock               sync.RWMutex                    // Read-write lock for require, which may be reloaded from requireFile
+	lock                      sync.RWMutex                    // Read-write lock for the issuerKeys and keyInfo maps
+	issuerKeys                map[string]map[string]any       // A map of issuers (or internalIssuer for secrets) to key IDs to public keys or shared HMAC secrets
+	fetchDone                 chan struct{}                   // Closed when the fetch routine has stopped, once the context given to New is done
+	optional                  bool                            // If true, requests without a token are allowed but any token provided must still be valid
+	unauthenticatedMethods    CaseInsensitiveSet              // A set of HTTP methods that bypass authentication entirely
+	redirectUnauthorized      *template.Template              // A template for redirecting unauthorized requests
+	redirectForbidden         *template.Template              // A template for redirecting forbidden requests
+	cookieName                string                          // The name of the cookie to extract the token from
+	headerName                string                          // The name of the header to extract the token from
+	parameterNames            []string                        // The names of the query parameters to extract the token from, tried in order
+	headerMap                 map[string]string               // A map of claim names to header names to forward to the backend
+	removeMissingHeaders      bool                            // If true, remove missing headers from the request
+	forwardToken              bool                            // If true, the token is forwarded to the backend
+	freshness                 time.Duration                   // The maximum age of a token, or 0 to not consider freshness
+	environment               map[string]string               // Map of environment variables
+	logUnauthorized           string                          // If set, log the details of the failed requirements to the level specified
+	denialReasonHeader        string                          // If set, the name of a response header in which to return a machine-readable reason for denial
+	forwardTokenHeader        string                          // If set, the name of a header in which to forward the raw token to the backend
+	splitClaims               map[string]string               // A map of claim names to delimiters for string claims to be split into lists before validation
+	authzURL                  string                          // If set, the URL of an external authorization decision service to consult after validation
+	authzFailOpen             bool                            // If true, allow requests when the authorization decision service can't be reached
+	authzCache                *authzCache                     // A cache of authorization decisions by issuer, subject, method and path, or nil if not caching
+	authzClient               *http.Client                    // The client for the authzURL, with the authzTimeout
+	validations               chan struct{}                   // A semaphore limiting the number of concurrent validations, or nil if unlimited
+	requireHeader             Requirement                     // A map of requirements for the token header (e.g. alg), validated as for require
+	forwardAuthMode           bool                            // If true, act as a traefik ForwardAuth server, returning 200 with the mapped headers in the response on success
+	setHeaders                map[string]string               // A map of header names to constant values to forward to the backend when authorized
+	secretsBundle             []jwt.VerificationKey           // A list of candidate public keys for tokens without a kid
+	requestIDHeader           string                          // If set, the header from which to take (or in which to generate) a correlation id for logging
+	openidConfigPath          string                          // The path of the OpenID configuration relative to the issuer
+	jwksPath                  string                          // The path of the JWKS relative to the issuer, used if the OpenID configuration can't be fetched
+	issuerTemplates           []*template.Template            // Templates for issuers derived per-request, e.g. from the Host, for multi-tenant issuers
+	validator                 *jwt.Validator                  // Validates the claims after coercing the time claims if lenientTimeClaims is set, otherwise nil (the parser validates)
+	keyInfo                   map[string]map[string]KeyInfo   // A map of issuers to key IDs to descriptions of the keys in issuerKeys, for Keys
+	maxFutureIat              time.Duration                   // The maximum time that a token's iat may be in the future, or 0 for no limit
+	rejectPrivateJWKS         bool                            // Whether to fail a JWKS fetch that contains private keys rather than just skipping them
+	keyRetention              time.Duration                   // How long to keep accepting keys after they are removed from their issuer's JWKS, or 0
+	retiredKeys               map[string]map[string]time.Time // A map of issuers to key IDs of keys retained after removal from the JWKS to when they expire
+	refreshHeader             string                          // A response header to set to "required" when a 401 is for a stale token that may be resolved by refreshing it
+	hostAudience              []hostAudience                  // Audiences required for request hosts matching a pattern, most specific pattern first
+	requireScopes             []string                        // Scopes that must all be granted by the token in any of the scopeClaims
+	scopeClaims               []string                        // The claims that may hold the token's scopes, as a space-delimited string or an array
+	refetchOnSignatureFailure bool                            // Whether to refetch an issuer's keys once when a token fails signature verification with its cached key
+	signatureRefetches        *refetchLimiter                 // Limits how often keys are refetched for each issuer after signature failures
+	defaultIssuer             string                          // The canonicalized issuer to fetch keys from for tokens without an iss, if set
+	discoveryCache            *discoveryCache                 // A cache of OpenID configurations, or nil if discoveryTTL is not set
+	ignoredSchemes            []string                        // Authorization schemes (lowercase) in headerName that are never our token and so are treated as no token
+	coerceBooleans            bool                            // If set, "true" and "false" string claims match boolean requirements
+	signHeaders               []byte                          // If set, the shared secret for the HMAC of the mapped headers sent in signatureHeader
+	stripAllTokenSources      bool                            // If set (and forwardToken is not), all of the token sources are removed from the request, not just the one the token came from
+	failOpenPaths             []string                        // Path globs on which requests failing validation are logged but allowed through anyway
+	cacheControl              string                          // If set, the Cache-Control header for responses to requests authorized by a token, unless set by the backend
+	grpcDetection             string                          // How gRPC requests are detected, to return gRPC compatible denials: content-type, strict or lenient
+	minRSABits                int                             // The minimum size of RSA keys; smaller fetched keys are ignored and smaller configured keys are an error
+	normalizeKid              bool                            // If set, the token kid is trimmed of whitespace and URL-decoded before lookup
+	subjectHeader             string                          // If set, the header to set to the authenticated subject, e.g. for downstream rate limiting
+	subjectClaims             []string                        // The claims tried in order for the subject in subjectHeader
+	unknownKids               *unknownKidCache                // Kids recently found to be unknown to their issuer, or nil if unknownKidTTL is not set
+	keySource                 KeySource                       // The source of the keys for issuers, which is HTTP JWKS endpoints unless set by SetKeySource
+	exactAudience             []string                        // If set, the exact set of audiences that a token aud must have, from the aud in require
+	exactHostAudience         bool                            // If set, a token aud must be exactly the audience for the host in hostAudience
+	requireTLSIssuers         bool                            // If set, keys are never fetched over plaintext HTTP, except from loopback addresses
+	reportAllFailures         bool                            // If set, all requirements are evaluated and every failure is reported, rather than only the first
+	stateSecret               []byte                          // If set, the shared secret for the HMAC of the nonce and issue time in the State template variable
+	stateMaxAge               time.Duration                   // The maximum age of a returned state, and the lifetime of the state cookie binding it to the browser
+	stateCookie               *http.Cookie                    // The prototype of the cookie that binds a state to the browser it was issued to
+	websocketProtocolToken    bool                            // If set, tokens are also taken from the Sec-WebSocket-Protocol header of WebSocket upgrades
+	websocketProtocolPrefix   string                          // The prefix of the sub-protocol carrying the token, or empty for a sub-protocol that is just the token
+	clientCertBypass          []string                        // Globs of the subject CNs and SANs of verified client certificates that are allowed without a token
+	userAgent                 string                          // The User-Agent of the requests made to fetch OpenID configurations and keys
+	clearCookie               *http.Cookie                    // If set, the cookie to send to clear the token cookie when a request carrying it is unauthorized
+	optionalClaims            []string                        // Claims in require that are allowed to be absent, but must match if present
+	adminPath                 string                          // If set, the path of the admin endpoint to which new require rules may be POSTed
+	adminSecret               []byte                          // The bearer secret that authorizes requests to the admin endpoint
+	tracer                    Tracer                          // The tracer of validation spans, or nil for none, as set by SetTracer
+	optionalMethods           CaseInsensitiveSet              // If not empty, the HTTP methods to which optional applies, with all others requiring a token
+	requireSubject            bool                            // If set, tokens must have a non-empty string sub claim
+	lazyIssuers               bool                            // If set, keys are only fetched, and refreshed, for issuers once a token from them has been seen
+	revocationURL             string                          // If set, the URL of the list of revoked subs and jtis, fetched at startup and each refreshKeysInterval
+	revocationFailOpen        bool                            // If set, tokens are accepted by the last known (or an empty) revocation list when it can't be fetched
+	revocations               *revocations                    // The revoked subs and jtis from revocationURL, or nil if it isn't set
+	fetchBreaker              *circuitBreaker                 // Suppresses fetches from issuers that keep failing, or nil if circuitBreakerThreshold is not set
+	renameTokenHeader         string                          // If set, the name of a header to which a token from headerName is moved, rather than being removed, when forwardToken is false
+	notYetValidStatus         int                             // If set, the status for a genuine token whose nbf is in the future, with a Retry-After until then
+	routeRequire              []routeRequirement              // Requirements that add to (or replace) require for requests matching their paths and methods
+	maxTokenLifetime          time.Duration                   // The maximum time from a token's iat to its exp, or 0 for no limit
+	requireLifetimeClaims     bool                            // If set (with maxTokenLifetime), tokens without both iat and exp are rejected rather than not checked
+	decisionCache             *decisionCache                  // Recent decisions for tokens and the requests presenting them, or nil if decisionCacheDuration is not set
+	claimsPointer             string                          // The JSON Pointer to the object within the token holding the claims to validate and map to headers, or "" for the top level
+	requireTemplates          bool                            // If require uses templates; guarded by requireLock as require may be replaced
+	otherTemplates            bool                            // If redirects, issuers, requireHeader or routeRequire use templates
+	echoClaimsPath            string                          // If set, the path of the debugging endpoint that responds with the claims of a valid token
+	multipleHeaderValues      string                          // How a token header with multiple values is handled: first, any or reject
+	maxJWKSBytes              int64                           // The maximum size of a JWKS or discovery response
+}
+
+// KeyInfo describes a key held by the plugin, without the key material.
+type KeyInfo struct {
+	Kid       string    // The key ID
+	Alg       string    // The algorithm family of the key: RSA, EC (with curve) or HMAC
+	Issuer    string    // The issuer the key was fetched for, or "internal" for keys from secrets
+	FetchedAt time.Time // When the key was fetched or loaded
 }
 
 // TemplateVariables are the per-request variables passed to Go templates for interpolation, such as the require and redirect templates.
@@ -89,11 +307,26 @@ type TemplateVariables map[string]string
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "HS256", "HS384", "HS512"},
-		CookieName:   "Authorization",
-		HeaderName:   "Authorization",
-		ForwardToken: true,
-		Freshness:    3600,
+		ValidMethods:           []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "HS256", "HS384", "HS512"},
+		CookieName:             "Authorization",
+		HeaderName:             "Authorization",
+		ForwardToken:           true,
+		Freshness:              3600,
+		AuthzCacheDuration:     "10s",
+		AuthzTimeout:           "5s",
+		UserHeader:             "X-Auth-Request-User",
+		EmailHeader:            "X-Auth-Request-Email",
+		OpenIDConfigPath:       ".well-known/openid-configuration",
+		JWKSPath:               ".well-known/jwks.json",
+		GRPCDetection:          grpcDetectionContentType,
+		MultipleHeaderValues:   multipleValuesFirst,
+		RequireTLSIssuers:      true,
+		UserAgent:              defaultUserAgent,
+		CookiePath:             "/",
+		CookieSecure:           true,
+		CookieHTTPOnly:         true,
+		CircuitBreakerCooldown: "1m",
+		StateMaxAge:            "10m",
 	}
 }
 
@@ -125,11 +358,76 @@ func setupKey(raw string, base64Encoded bool) (any, error) {
 	if strings.HasPrefix(raw, "-----BEGIN RSA PUBLIC KEY") || strings.HasPrefix(raw, "-----BEGIN PUBLIC KEY") {
 		return jwt.ParseRSAPublicKeyFromPEM([]byte(raw))
 	}
+	// Any other PEM, such as a private key or certificate, is a misconfiguration rather than an HMAC secret
+	if strings.HasPrefix(raw, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(raw))
+		if block == nil {
+			return nil, fmt.Errorf("invalid key: malformed PEM")
+		}
+		return nil, fmt.Errorf("invalid key: unsupported PEM type %s; expected a public key", block.Type)
+	}
 
 	// Otherwise, we assume it's a shared HMAC secret
 	return []byte(raw), nil
 }
 
+// DerivedSecret is the configuration of an HMAC secret derived from a master secret with HKDF (RFC 5869) using SHA-256,
+// as used by issuers that sign with a different key for each purpose without sharing the master secret.
+type DerivedSecret struct {
+	Master string `json:"master,omitempty"`
+	Salt   string `json:"salt,omitempty"`
+	Info   string `json:"info,omitempty"`
+	Length int    `json:"length,omitempty"` // The length of the derived key in bytes; default 32
+}
+
+// key derives the HMAC secret.
+func (derived *DerivedSecret) key() ([]byte, error) {
+	if derived.Master == "" {
+		return nil, fmt.Errorf("master is required")
+	}
+	length := derived.Length
+	if length < 0 {
+		return nil, fmt.Errorf("length must be positive; got %d", length)
+	}
+	if length == 0 {
+		length = sha256.Size
+	}
+	return hkdf.Key(sha256.New, []byte(derived.Master), []byte(derived.Salt), derived.Info, length)
+}
+
+// setupKeyBundle parses all the PEM-encoded public keys in `raw`, which may be given inline or as a path to a file.
+func setupKeyBundle(raw string) ([]jwt.VerificationKey, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	content, err := pemContent(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []jwt.VerificationKey
+	rest := []byte(content)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if !strings.HasSuffix(block.Type, "PUBLIC KEY") {
+			return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+		}
+		key, err := setupKey(string(pem.EncodeToMemory(block)), false)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found")
+	}
+	return keys, nil
+}
+
 // environment returns the environment variables as a map
 func environment() map[string]string {
 	environment := os.Environ()
@@ -141,14 +439,53 @@ func environment() map[string]string {
 	return variables
 }
 
+// checkUnknownKeys returns an error listing any configuration keys that don't match a field of Config if strictConfig is set,
+// since a misspelt key such as requre would otherwise be silently ignored, or else logs a warning.
+func checkUnknownKeys(config *Config) error {
+	if len(config.Unknown) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(config.Unknown))
+	for key := range config.Unknown {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if config.StrictConfig {
+		return fmt.Errorf("unknown configuration keys: %s", strings.Join(keys, ", "))
+	}
+	logger.Log("WARN", "ignoring unknown configuration keys: %s", strings.Join(keys, ", "))
+	return nil
+}
+
 // New creates a new JWTPlugin.
-func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	log.SetFlags(0)
+	err := expandConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	err = checkUnknownKeys(config)
+	if err != nil {
+		return nil, err
+	}
 
 	key, err := setupKey(config.Secret, config.SecretBase64Encoded)
 	if err != nil {
 		return nil, err
 	}
+	if config.DerivedSecret != nil {
+		if key != nil {
+			return nil, fmt.Errorf("secret and derivedSecret can't both be set")
+		}
+		key, err = config.DerivedSecret.key()
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivedSecret: %v", err)
+		}
+	}
+	err = checkRSABits(key, config.MinRSABits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %v", err)
+	}
 
 	for index, pem := range config.RootCAs {
 		pem, err := pemContent(pem)
@@ -158,40 +495,309 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		config.RootCAs[index] = pem
 	}
 
-	issuers, issuerJWKSEndpoints, err := parseIssuers(config.Issuers)
+	issuers, issuerJWKSEndpoints, issuerKeyFormats, issuerAdditionalJWKS, err := parseIssuers(config.Issuers)
+	if err != nil {
+		return nil, err
+	}
+	issuers, issuerTemplates, err := splitIssuerTemplates(issuers)
+	if err != nil {
+		return nil, err
+	}
+	defaultIssuer := ""
+	if config.DefaultIssuer != "" {
+		// The default issuer is implicitly trusted
+		defaultIssuer = canonicalizeDomain(config.DefaultIssuer)
+		issuers = append(issuers, defaultIssuer)
+	}
+	err = validateIssuers(issuers, issuerJWKSEndpoints, issuerAdditionalJWKS, config.RequireTLSIssuers)
+	if err != nil {
+		return nil, err
+	}
+	if config.RequireTLSIssuers && isPlaintextURL(config.RevocationURL) {
+		// Anyone able to intercept the connection could otherwise reinstate revoked tokens
+		return nil, fmt.Errorf("invalid revocationURL %s: must not be fetched over plaintext http unless requireTLSIssuers is false", config.RevocationURL)
+	}
+
+	secretsBundle, err := setupKeyBundle(config.SecretsBundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secretsBundle: %v", err)
+	}
+	for _, key := range secretsBundle {
+		err = checkRSABits(key, config.MinRSABits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secretsBundle: %v", err)
+		}
+	}
+
+	if config.RequireNonEmpty && len(config.Require) == 0 && config.RequireFile == "" {
+		return nil, fmt.Errorf("requireNonEmpty is set but no require or requireFile is configured")
+	}
+
+	require, err := newRequire(config.Require, config.RequireFile, config.OptionalClaims)
+	if err != nil {
+		return nil, err
+	}
+	routeRequire, err := parseRouteRequire(config.RouteRequire, config.OptionalClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	headerMap, err := newHeaderMap(config)
+	if err != nil {
+		return nil, err
+	}
+
+	authzCacheDuration, err := parseDuration(config.AuthzCacheDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authzCacheDuration: %v", err)
+	}
+
+	authzTimeout, err := parseDuration(config.AuthzTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authzTimeout: %v", err)
+	}
+
+	maxFutureIat, err := parseDuration(config.MaxFutureIat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxFutureIat: %v", err)
+	}
+
+	stateMaxAge, err := parseDuration(config.StateMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stateMaxAge: %v", err)
+	}
+	if config.StateSecret != "" && stateMaxAge <= 0 {
+		return nil, fmt.Errorf("invalid stateMaxAge: must be positive when stateSecret is set")
+	}
+
+	maxTokenLifetime, err := parseDuration(config.MaxTokenLifetime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxTokenLifetime: %v", err)
+	}
+
+	decisionCacheDuration, err := parseDuration(config.DecisionCacheDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decisionCacheDuration: %v", err)
+	}
+
+	if config.Freshness < 0 {
+		return nil, fmt.Errorf("invalid freshness: must not be negative; got %d", config.Freshness)
+	}
+	freshness := time.Duration(config.Freshness) * time.Second
+	if config.FreshnessDuration != "" {
+		// Given as a duration, it takes the place of freshness in seconds
+		freshness, err = parseDuration(config.FreshnessDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid freshnessDuration: %v", err)
+		}
+		if freshness < 0 {
+			return nil, fmt.Errorf("invalid freshnessDuration: must not be negative; got %s", config.FreshnessDuration)
+		}
+	}
+
+	keyRetention, err := parseDuration(config.KeyRetention)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyRetention: %v", err)
+	}
+
+	switch config.GRPCDetection {
+	case "", grpcDetectionContentType, grpcDetectionStrict, grpcDetectionLenient:
+	default:
+		return nil, fmt.Errorf("invalid grpcDetection %q: expected %s, %s or %s", config.GRPCDetection, grpcDetectionContentType, grpcDetectionStrict, grpcDetectionLenient)
+	}
+
+	switch config.MultipleHeaderValues {
+	case "", multipleValuesFirst, multipleValuesAny, multipleValuesReject:
+	default:
+		return nil, fmt.Errorf("invalid multipleHeaderValues %q: expected %s, %s or %s", config.MultipleHeaderValues, multipleValuesFirst, multipleValuesAny, multipleValuesReject)
+	}
+
+	exactAudience, err := newExactAudience(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clearCookie, err := newClearCookie(config)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.AdminPath != "" && len(config.AdminSecret) < minAdminSecretLength {
+		return nil, fmt.Errorf("adminPath requires an adminSecret of at least %d characters", minAdminSecretLength)
+	}
+
+	if config.NotYetValidStatus != 0 && (config.NotYetValidStatus < 400 || config.NotYetValidStatus > 599) {
+		return nil, fmt.Errorf("notYetValidStatus must be a 4xx or 5xx status; got %d", config.NotYetValidStatus)
+	}
+
+	if config.RenameTokenHeader != "" && (config.ForwardToken || config.HeaderName == "" || strings.EqualFold(config.RenameTokenHeader, config.HeaderName)) {
+		return nil, fmt.Errorf("renameTokenHeader requires forwardToken to be false and a different headerName")
+	}
+
+	unknownKidTTL, err := parseDuration(config.UnknownKidTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unknownKidTTL: %v", err)
+	}
+
+	discoveryTTL, err := parseDuration(config.DiscoveryTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discoveryTTL: %v", err)
+	}
+
+	fetchTimeout, err := parseDuration(config.FetchTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fetchTimeout: %v", err)
+	}
+	if config.CircuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("circuitBreakerThreshold must not be negative")
+	}
+	circuitBreakerCooldown, err := parseDuration(config.CircuitBreakerCooldown)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuitBreakerCooldown: %v", err)
+	}
+
+	parser, validator := newParser(config)
+
 	plugin := JWTPlugin{
-		next:                   next,
-		name:                   name,
-		parser:                 jwt.NewParser(jwt.WithValidMethods(config.ValidMethods), jwt.WithJSONNumber()),
-		secret:                 key,
-		issuers:                issuers,
-		issuerJWKSEndpoints:    issuerJWKSEndpoints,
-		clients:                NewClients(config.InsecureSkipVerify),
-		defaultClient:          NewDefaultClient(config.RootCAs, true),
-		require:                NewRequirement(config.Require, "$and"),
-		keys:                   make(map[string]any),
-		issuerKeys:             make(map[string]map[string]any),
-		optional:               config.Optional,
-		unauthenticatedMethods: NewCaseInsensitiveSet(config.UnauthenticatedMethods),
-		redirectUnauthorized:   NewTemplate(config.RedirectUnauthorized),
-		redirectForbidden:      NewTemplate(config.RedirectForbidden),
-		cookieName:             config.CookieName,
-		headerName:             config.HeaderName,
-		parameterName:          config.ParameterName,
-		headerMap:              config.HeaderMap,
-		removeMissingHeaders:   config.RemoveMissingHeaders,
-		forwardToken:           config.ForwardToken,
-		freshness:              config.Freshness,
-		logUnauthorized:        strings.ToUpper(config.LogUnauthorized),
-		environment:            environment(),
-	}
-
-	// If we have keys/secrets, add them to the key cache
+		next:                      next,
+		name:                      name,
+		parser:                    parser,
+		validator:                 validator,
+		secret:                    key,
+		issuers:                   issuers,
+		issuerJWKSEndpoints:       issuerJWKSEndpoints,
+		issuerKeyFormats:          issuerKeyFormats,
+		issuerAdditionalJWKS:      issuerAdditionalJWKS,
+		clients:                   NewClients(config.InsecureSkipVerify),
+		defaultClient:             NewDefaultClient(config.RootCAs, true),
+		require:                   require,
+		requireInline:             config.Require,
+		requireFile:               config.RequireFile,
+		issuerKeys:                make(map[string]map[string]any),
+		optional:                  config.Optional,
+		unauthenticatedMethods:    NewCaseInsensitiveSet(config.UnauthenticatedMethods),
+		redirectUnauthorized:      NewTemplate(config.RedirectUnauthorized),
+		redirectForbidden:         NewTemplate(config.RedirectForbidden),
+		cookieName:                config.CookieName,
+		headerName:                config.HeaderName,
+		parameterNames:            newParameterNames(config.ParameterName, config.ParameterNames),
+		headerMap:                 headerMap,
+		removeMissingHeaders:      config.RemoveMissingHeaders,
+		forwardToken:              config.ForwardToken,
+		freshness:                 freshness,
+		logUnauthorized:           strings.ToUpper(config.LogUnauthorized),
+		environment:               environment(),
+		denialReasonHeader:        config.DenialReasonHeader,
+		forwardTokenHeader:        config.ForwardTokenHeader,
+		splitClaims:               config.SplitClaims,
+		authzURL:                  config.AuthzURL,
+		authzFailOpen:             config.AuthzFailOpen,
+		authzCache:                newAuthzCache(authzCacheDuration),
+		validations:               newSemaphore(config.MaxConcurrentValidations),
+		requireHeader:             NewRequirement(config.RequireHeader, "$and"),
+		forwardAuthMode:           config.ForwardAuthMode,
+		setHeaders:                config.SetHeaders,
+		secretsBundle:             secretsBundle,
+		requestIDHeader:           config.RequestIDHeader,
+		openidConfigPath:          strings.TrimPrefix(config.OpenIDConfigPath, "/"),
+		jwksPath:                  strings.TrimPrefix(config.JWKSPath, "/"),
+		issuerTemplates:           issuerTemplates,
+		keyInfo:                   map[string]map[string]KeyInfo{internalIssuer: {}},
+		maxFutureIat:              maxFutureIat,
+		rejectPrivateJWKS:         config.RejectPrivateJWKS,
+		keyRetention:              keyRetention,
+		retiredKeys:               make(map[string]map[string]time.Time),
+		refreshHeader:             config.RefreshHeader,
+		hostAudience:              newHostAudience(config.HostAudience),
+		requireScopes:             config.RequireScopes,
+		scopeClaims:               newScopeClaims(config.ScopeClaims),
+		refetchOnSignatureFailure: config.RefetchOnSignatureFailure,
+		signatureRefetches:        newRefetchLimiter(signatureRefetchInterval),
+		defaultIssuer:             defaultIssuer,
+		discoveryCache:            newDiscoveryCache(discoveryTTL),
+		ignoredSchemes:            newIgnoredSchemes(config.IgnoredSchemes),
+		coerceBooleans:            config.CoerceBooleans,
+		signHeaders:               []byte(config.SignHeaders),
+		stripAllTokenSources:      config.StripAllTokenSources,
+		failOpenPaths:             config.FailOpenPaths,
+		cacheControl:              config.CacheControl,
+		grpcDetection:             config.GRPCDetection,
+		minRSABits:                config.MinRSABits,
+		normalizeKid:              config.NormalizeKid,
+		subjectHeader:             config.SubjectHeader,
+		subjectClaims:             newSubjectClaims(config.SubjectClaims),
+		unknownKids:               newUnknownKidCache(unknownKidTTL),
+		exactAudience:             exactAudience,
+		exactHostAudience:         config.ExactAudience && len(config.HostAudience) > 0,
+		requireTLSIssuers:         config.RequireTLSIssuers,
+		reportAllFailures:         config.ReportAllFailures,
+		stateSecret:               []byte(config.StateSecret),
+		stateMaxAge:               stateMaxAge,
+		stateCookie:               newStateCookie(config, stateMaxAge),
+		websocketProtocolToken:    config.WebsocketProtocolToken,
+		websocketProtocolPrefix:   config.WebsocketProtocolPrefix,
+		clientCertBypass:          config.ClientCertBypass,
+		userAgent:                 config.UserAgent,
+		clearCookie:               clearCookie,
+		optionalClaims:            config.OptionalClaims,
+		adminPath:                 config.AdminPath,
+		adminSecret:               []byte(config.AdminSecret),
+		optionalMethods:           NewCaseInsensitiveSet(config.OptionalMethods),
+		requireSubject:            config.RequireSubject,
+		lazyIssuers:               config.LazyIssuers,
+		revocationURL:             config.RevocationURL,
+		revocationFailOpen:        config.RevocationFailOpen,
+		revocations:               newRevocations(config.RevocationURL),
+		fetchBreaker:              newCircuitBreaker(config.CircuitBreakerThreshold, circuitBreakerCooldown),
+		renameTokenHeader:         config.RenameTokenHeader,
+		notYetValidStatus:         config.NotYetValidStatus,
+		routeRequire:              routeRequire,
+		maxTokenLifetime:          maxTokenLifetime,
+		requireLifetimeClaims:     config.RequireLifetimeClaims,
+		decisionCache:             newDecisionCache(decisionCacheDuration, config.DecisionCacheSize),
+		claimsPointer:             claimsPointer(config.ClaimsPath),
+		echoClaimsPath:            config.EchoClaimsPath,
+		multipleHeaderValues:      config.MultipleHeaderValues,
+		maxJWKSBytes:              newMaxJWKSBytes(config.MaxJWKSBytes),
+	}
+	plugin.keySource = httpKeySource{plugin: &plugin}
+	plugin.requireTemplates = usesTemplates(require)
+	plugin.otherTemplates = plugin.redirectUnauthorized != nil || plugin.redirectForbidden != nil || len(issuerTemplates) > 0 ||
+		usesTemplates(plugin.requireHeader)
+	for _, route := range routeRequire {
+		plugin.otherTemplates = plugin.otherTemplates || usesTemplates(route.requirement)
+	}
+	setClientTimeouts(plugin.clients, plugin.defaultClient, fetchTimeout)
+	if plugin.authzURL != "" {
+		// A copy, as the decision service's timeout is its own, rather than the fetchTimeout shared with the issuers
+		authzClient := *plugin.clientForURL(plugin.authzURL)
+		authzClient.Timeout = authzTimeout
+		plugin.authzClient = &authzClient
+	}
+
+	if plugin.echoClaimsPath != "" {
+		logger.Log("WARN", "echoClaimsPath is set: the claims of any valid token are returned to the client at %s. This is for debugging integrations and shouldn't be used in production", plugin.echoClaimsPath)
+	}
+	if _, ok := plugin.clients[wildcardHost]; ok {
+		logger.Log("WARN", "insecureSkipVerify is set for ALL hosts: issuer certificates will not be verified, so keys may be spoofed. This must never be used in production")
+	}
+
+	// If we have keys/secrets, add them to the key cache. As they're not fetched, they are never purged.
+	internal, err := setupInlineJWKS(config.InlineJWKS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inlineJWKS: %v", err)
+	}
+	for kid, key := range internal {
+		err = checkRSABits(key, config.MinRSABits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inlineJWKS: kid %s: %v", kid, err)
+		}
+		plugin.keyInfo[internalIssuer][kid] = KeyInfo{Kid: kid, Alg: keyAlgorithm(key), Issuer: internalIssuer, FetchedAt: time.Now()}
+	}
 	for kid, raw := range config.Secrets {
+		if kid == "" {
+			return nil, fmt.Errorf("secrets: kid must not be empty")
+		}
 		key, err := setupKey(raw, config.SecretBase64Encoded)
 		if err != nil {
 			return nil, fmt.Errorf("kid %s: %v", kid, err)
@@ -199,13 +805,22 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		if key == nil {
 			return nil, fmt.Errorf("kid %s: invalid key: Key is empty", kid)
 		}
-		plugin.keys[kid] = key
+		err = checkRSABits(key, config.MinRSABits)
+		if err != nil {
+			return nil, fmt.Errorf("kid %s: %v", kid, err)
+		}
+		if kid == wildcardKid {
+			plugin.wildcardSecret = key
+			continue
+		}
+		internal[kid] = key
+		plugin.keyInfo[internalIssuer][kid] = KeyInfo{Kid: kid, Alg: keyAlgorithm(key), Issuer: internalIssuer, FetchedAt: time.Now()}
 	}
-	plugin.issuerKeys["internal"] = internalIssuerKeys(config.Secrets)
+	plugin.issuerKeys[internalIssuer] = internal
 
 	// Set up the prefetch and refresh intervals and the fetch routine
 	var delayPrefetch time.Duration
-	if config.SkipPrefetch {
+	if config.SkipPrefetch || config.LazyIssuers {
 		delayPrefetch = -1
 	} else {
 		delayPrefetch, err = parseDuration(config.DelayPrefetch)
@@ -218,18 +833,43 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		return nil, fmt.Errorf("invalid refreshKeysInterval: %v", err)
 	}
 
-	go plugin.fetchRoutine(delayPrefetch, refreshKeysInterval) // this is a noop if neither are required
+	plugin.fetchDone = make(chan struct{})
+	go plugin.fetchRoutine(ctx, delayPrefetch, refreshKeysInterval) // this is a noop if none are required
 
 	return &plugin, nil
 }
 
-// internalIssuerKeys returns a dummy keyset for the keys in config.Secrets
-func internalIssuerKeys(secrets map[string]string) map[string]any {
-	keys := make(map[string]any, len(secrets))
-	for kid := range secrets {
-		keys[kid] = nil
+// newHeaderMap returns the headerMap configuration with the userClaim and emailClaim conveniences added to it.
+// Header names are canonicalized, and it is an error for two different claims to be mapped to the same header
+// (e.g. by names differing only in case), as which claim's value was forwarded would otherwise be arbitrary.
+func newHeaderMap(config *Config) (map[string]string, error) {
+	headerMap := make(map[string]string, len(config.HeaderMap)+2)
+	add := func(header string, claim string) error {
+		header = http.CanonicalHeaderKey(header)
+		if existing, ok := headerMap[header]; ok && existing != claim {
+			claims := []string{existing, claim}
+			sort.Strings(claims) // as the order of the headerMap is random
+			return fmt.Errorf("headerMap maps both %s and %s to header %s", claims[0], claims[1], header)
+		}
+		headerMap[header] = claim
+		return nil
 	}
-	return keys
+	for header, claim := range config.HeaderMap {
+		if err := add(header, claim); err != nil {
+			return nil, err
+		}
+	}
+	if config.UserClaim != "" && config.UserHeader != "" {
+		if err := add(config.UserHeader, config.UserClaim); err != nil {
+			return nil, err
+		}
+	}
+	if config.EmailClaim != "" && config.EmailHeader != "" {
+		if err := add(config.EmailHeader, config.EmailClaim); err != nil {
+			return nil, err
+		}
+	}
+	return headerMap, nil
 }
 
 // parseDuration parses a duration string or returns 0 if the string is empty.
@@ -240,31 +880,204 @@ func parseDuration(duration string) (time.Duration, error) {
 	return time.ParseDuration(duration)
 }
 
-// fetchRoutine prefetches and refreshes keys for all issuers in the plugin's configuration optionally at the given intervals.
-func (plugin *JWTPlugin) fetchRoutine(delayPrefetch time.Duration, refreshKeysInterval time.Duration) {
+// fetchRoutine prefetches and refreshes keys for all issuers in the plugin's configuration optionally at the given intervals,
+// together with any revocation list. It stops once ctx is done, closing fetchDone.
+func (plugin *JWTPlugin) fetchRoutine(ctx context.Context, delayPrefetch time.Duration, refreshKeysInterval time.Duration) {
+	defer close(plugin.fetchDone)
 	// If we have an initial delay, which may be 0, wait for that before the first fetch
 	if delayPrefetch != -1 {
-		time.Sleep(delayPrefetch)
+		if !sleep(ctx, delayPrefetch) {
+			return
+		}
 		plugin.fetchAllKeys()
 	}
-	// If we have a refresh interval, loop forever fetching keys at that interval
+	plugin.fetchRevocations()
+	// If we have a refresh interval, loop until ctx is done fetching keys (and reloading any requireFile and revocation list) at that interval
 	if refreshKeysInterval != 0 {
-		for {
-			time.Sleep(refreshKeysInterval)
+		for sleep(ctx, refreshKeysInterval) {
 			plugin.fetchAllKeys()
+			plugin.reloadRequire()
+			plugin.fetchRevocations()
+		}
+	}
+}
+
+// sleep waits for the duration, returning false if ctx is done first.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newRequire creates the Requirement from the inline require configuration combined with any requirements in requireFile.
+// Both must be satisfied: the requirements in the file are effectively ANDed with the inline ones.
+// The optional claims are allowed to be absent from the token in either.
+func newRequire(inline map[string]any, file string, optional []string) (requirement Requirement, err error) {
+	if file == "" {
+		return MakeOptional(NewRequirement(inline, "$and"), optional), nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load requireFile: %v", err)
+	}
+	var external map[string]any
+	err = yaml.Unmarshal(content, &external) // YAML is a superset of JSON, so this handles both
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse requireFile: %v", err)
+	}
+
+	// NewRequirement panics on bad configuration, which we can't allow to happen on a reload in the background
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			requirement, err = nil, fmt.Errorf("invalid requireFile: %v", recovered)
 		}
+	}()
+	return MakeOptional(AndRequirement{requirements: []Requirement{NewRequirement(inline, "$and"), NewRequirement(external, "$and")}}, optional), nil
+}
+
+// reloadRequire reloads the requirements from requireFile, if configured, keeping the current requirements if this fails.
+func (plugin *JWTPlugin) reloadRequire() {
+	if plugin.requireFile == "" {
+		return
+	}
+	plugin.requireLock.RLock()
+	inline := plugin.requireInline // which may have been replaced by SetRequire
+	plugin.requireLock.RUnlock()
+	require, err := newRequire(inline, plugin.requireFile, plugin.optionalClaims)
+	if err != nil {
+		log.Printf("failed to reload %s: %v", plugin.requireFile, err)
+		return
+	}
+	plugin.requireLock.Lock()
+	plugin.require = require
+	plugin.requireTemplates = usesTemplates(require)
+	plugin.requireLock.Unlock()
+	plugin.invalidateDecisions()
+}
+
+// usesTemplates returns true if any templates are configured, which need the full set of template variables for each request.
+func (plugin *JWTPlugin) usesTemplates() bool {
+	if plugin.otherTemplates {
+		return true
+	}
+	plugin.requireLock.RLock()
+	defer plugin.requireLock.RUnlock()
+	return plugin.requireTemplates
+}
+
+// requirement returns the current Requirement, which may be reloaded concurrently.
+func (plugin *JWTPlugin) requirement() Requirement {
+	plugin.requireLock.RLock()
+	defer plugin.requireLock.RUnlock()
+	return plugin.require
+}
+
+// newSemaphore returns a semaphore channel with the given capacity, or nil if capacity is 0 (unlimited).
+func newSemaphore(capacity int) chan struct{} {
+	if capacity <= 0 {
+		return nil
 	}
+	return make(chan struct{}, capacity)
 }
 
 // ServeHTTP is the middleware entry point.
 func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if plugin.adminPath != "" && request.URL.Path == plugin.adminPath {
+		plugin.serveAdmin(response, request)
+		return
+	}
+	if plugin.echoClaimsPath != "" && request.URL.Path == plugin.echoClaimsPath {
+		plugin.serveEchoClaims(response, request)
+		return
+	}
+	if !plugin.acquireValidation() {
+		// Too many validations in flight: shed load rather than queuing unbounded
+		response.Header().Set("Retry-After", "1")
+		http.Error(response, "too many concurrent requests", http.StatusServiceUnavailable)
+		return
+	}
+	// Release the slot once validated rather than holding it while next serves, but deferred so that a panic in validation can't leak it
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			plugin.releaseValidation()
+		}
+	}
+	defer release()
+	// Headers to forward go to the backend in the request, or back to traefik in the response for ForwardAuth
+	headers := request.Header
+	if plugin.forwardAuthMode {
+		headers = response.Header()
+	}
+	plugin.ensureRequestID(request)
 	variables := plugin.NewTemplateVariables(request)
-	status, err := plugin.validate(request, variables)
+	websocketProtocol := plugin.acceptedWebsocketProtocol(request) // before validate may remove the token's sub-protocol
+	clearCookie := plugin.clearCookie != nil && hasCookie(request, plugin.clearCookie.Name)
+	endSpan := plugin.startValidationSpan(request.Context(), variables)
+	status, authenticated, err := plugin.validate(request, headers, variables)
+	release()
+	if endSpan != nil {
+		endSpan(status, err)
+	}
 	if err == nil { // if NO error
+		if plugin.forwardAuthMode {
+			// As a ForwardAuth server, a 2xx tells traefik to allow the request
+			response.WriteHeader(http.StatusOK)
+			return
+		}
 		// Request is valid, pass to the next handler and we're done
+		if authenticated {
+			if websocketProtocol != "" {
+				// Set before next, as a proxy hijacks the connection for an upgrade rather than writing the header
+				response.Header().Set("Sec-WebSocket-Protocol", websocketProtocol)
+			}
+			defaults := map[string]string{}
+			if plugin.cacheControl != "" {
+				defaults["Cache-Control"] = plugin.cacheControl
+			}
+			if len(defaults) > 0 {
+				writer := &defaultHeaderWriter{ResponseWriter: response, defaults: defaults}
+				plugin.next.ServeHTTP(writer, request)
+				writer.setDefaults() // in case next wrote nothing, in which case the headers are yet to be sent
+				return
+			}
+		}
+		plugin.next.ServeHTTP(response, request)
+	} else if plugin.isFailOpenPath(request.URL.Path) {
+		// Validation is still done, but failures are only logged, e.g. while soak-testing a rollout. As no claims have been
+		// mapped, any headers the client sent in their place mustn't reach the backend.
+		requestLog(variables, "ERROR", "allowing request to fail-open path %s despite validation failure: %v", request.URL.Path, err)
+		plugin.removeMappedHeaders(headers)
+		if plugin.forwardAuthMode {
+			response.WriteHeader(http.StatusOK)
+			return
+		}
 		plugin.next.ServeHTTP(response, request)
 	} else {
 		// Request is invalid, handle the error appropriately for the configuration and request type
+		if plugin.denialReasonHeader != "" {
+			response.Header().Set(plugin.denialReasonHeader, denialReason(err))
+		}
+		if plugin.refreshHeader != "" && errors.As(err, &staleTokenError{}) {
+			// Hint to clients that they may be able to silently refresh the token rather than having to log in again
+			response.Header().Set(plugin.refreshHeader, "required")
+		}
+		var notYetValid notYetValidError
+		if errors.As(err, &notYetValid) {
+			// Hint to clients that they need only wait for the token to become valid
+			response.Header().Set("Retry-After", notYetValid.retryAfter())
+		}
+		if clearCookie && status == http.StatusUnauthorized {
+			// The browser would otherwise keep presenting the token that we have just refused
+			http.SetCookie(response, plugin.clearCookie)
+		}
 		if plugin.redirectUnauthorized != nil {
 			// Interactive clients should be redirected to the login page or unauthorized page.
 			var redirectTemplate *template.Template
@@ -279,8 +1092,14 @@ func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.R
 				http.Error(response, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if state := (*variables)["State"]; state != "" && plugin.stateCookie != nil {
+				// Bind the state to this browser, so that it can't be replayed from another
+				cookie := *plugin.stateCookie
+				cookie.Value = (*variables)["Nonce"]
+				http.SetCookie(response, &cookie)
+			}
 			http.Redirect(response, request, url, http.StatusFound)
-		} else if hasToken(request.Header.Get("Content-Type"), "application/grpc") {
+		} else if plugin.isGRPC(request) {
 			// If the request is a GRPC request, we return a GRPC compatible response.
 			header := response.Header()
 			header.Set("Content-Type", "application/grpc")
@@ -299,55 +1118,476 @@ func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.R
 	}
 }
 
-// validate is the entry point for the validation process.
-// It validates the request and returns the HTTP status code and an error if the request is not valid (i.e. if not http.StatusOK).
-// It also sets any headers that should be forwarded to the backend, as this is where we have the claims at hand.
-func (plugin *JWTPlugin) validate(request *http.Request, variables *TemplateVariables) (int, error) {
-	if plugin.unauthenticatedMethods.Contains(request.Method) {
-		return http.StatusOK, nil
-	}
+// defaultHeaderWriter is an http.ResponseWriter that sets default headers when the response is written, unless the
+// backend has set them itself, e.g. a Cache-Control header so that per-user responses aren't stored by shared caches.
+type defaultHeaderWriter struct {
+	http.ResponseWriter
+	defaults    map[string]string
+	wroteHeader bool
+}
 
-	token := plugin.extractToken(request)
-	if token == "" {
-		// No token provided
-		if !plugin.optional {
-			return http.StatusUnauthorized, fmt.Errorf("no token provided")
+// WriteHeader sets the default headers, if not already set, before writing the header.
+func (writer *defaultHeaderWriter) WriteHeader(status int) {
+	writer.setDefaults()
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// setDefaults sets the default headers, if not already set, the first time it is called before the header is written.
+func (writer *defaultHeaderWriter) setDefaults() {
+	if writer.wroteHeader {
+		return
+	}
+	writer.wroteHeader = true
+	for name, value := range writer.defaults {
+		if writer.Header().Get(name) == "" {
+			writer.Header().Set(name, value)
 		}
+	}
+}
 
-		plugin.removeMappedHeaders(request)
-	} else {
-		// Token provided
-		token, err := plugin.parser.Parse(token, plugin.getKey)
-		if err != nil {
-			return http.StatusUnauthorized, err
+// Write writes the header, as for http.ResponseWriter, if it hasn't yet been written.
+func (writer *defaultHeaderWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController, which also allows WebSocket upgrades to hijack it.
+func (writer *defaultHeaderWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// isOptional returns true if a token is optional for the method: for any method if optional is set, unless optionalMethods
+// is given, in which case for those methods only.
+func (plugin *JWTPlugin) isOptional(method string) bool {
+	if len(plugin.optionalMethods) > 0 {
+		return plugin.optionalMethods.Contains(method)
+	}
+	return plugin.optional
+}
+
+// isFailOpenPath returns true if the path matches any of the failOpenPaths globs.
+func (plugin *JWTPlugin) isFailOpenPath(path string) bool {
+	for _, pattern := range plugin.failOpenPaths {
+		if fnmatch.Match(pattern, path, 0) {
+			return true
 		}
+	}
+	return false
+}
 
-		claims := token.Claims.(jwt.MapClaims)
-		err = plugin.require.Validate(map[string]any(claims), variables)
-		if err != nil {
-			if plugin.allowRefresh(claims) {
-				return http.StatusUnauthorized, err
-			} else {
-				return http.StatusForbidden, err
+// The grpcDetection modes.
+const (
+	grpcDetectionContentType = "content-type" // A Content-Type of application/grpc
+	grpcDetectionStrict      = "strict"       // A Content-Type of application/grpc over HTTP/2, as gRPC requires
+	grpcDetectionLenient     = "lenient"      // A Content-Type of application/grpc, or TE: trailers as sent by all gRPC clients
+)
+
+// The multipleHeaderValues policies, for a token header with multiple values.
+const (
+	multipleValuesFirst  = "first"  // Use only the first value
+	multipleValuesAny    = "any"    // Try each value, using the first that is valid
+	multipleValuesReject = "reject" // Reject the request as unauthorized
+)
+
+// trustedClientCert returns the name in the request's client certificate that matches the clientCertBypass globs, if any.
+// Only a certificate that was verified by the TLS handshake counts. If TLS is terminated by a proxy in front of traefik,
+// the request has no TLS state and the bypass never applies.
+func (plugin *JWTPlugin) trustedClientCert(request *http.Request) (string, bool) {
+	if len(plugin.clientCertBypass) == 0 || request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	certificate := request.TLS.VerifiedChains[0][0]
+	names := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, pattern := range plugin.clientCertBypass {
+			if fnmatch.Match(pattern, name, 0) {
+				return name, true
 			}
 		}
-
-		plugin.mapClaimsToHeaders(claims, request)
 	}
+	return "", false
+}
 
-	return http.StatusOK, nil
+// isGRPC returns true if the request is detected as a gRPC request according to grpcDetection.
+func (plugin *JWTPlugin) isGRPC(request *http.Request) bool {
+	contentType := hasToken(request.Header.Get("Content-Type"), "application/grpc")
+	switch plugin.grpcDetection {
+	case grpcDetectionStrict:
+		return contentType && request.ProtoMajor == 2
+	case grpcDetectionLenient:
+		return contentType || hasToken(strings.ToLower(request.Header.Get("TE")), "trailers")
+	default:
+		return contentType
+	}
 }
 
-// Contains returns true if the set contains the given value, ignoring case.
-func (set CaseInsensitiveSet) Contains(value string) bool {
-	if len(set) == 0 {
+// acquireValidation acquires a slot for a validation without blocking, returning false if none is available.
+func (plugin *JWTPlugin) acquireValidation() bool {
+	if plugin.validations == nil {
+		return true
+	}
+	select {
+	case plugin.validations <- struct{}{}:
+		return true
+	default:
 		return false
 	}
-	_, found := set[strings.ToUpper(value)]
-	return found
 }
 
-// allowRefresh returns true if freshness window is configured and the token has an iat claim that is older than the freshness window.
+// releaseValidation releases the slot acquired by acquireValidation.
+func (plugin *JWTPlugin) releaseValidation() {
+	if plugin.validations != nil {
+		<-plugin.validations
+	}
+}
+
+// denialReason returns a machine-readable code describing why a request was denied, derived from the type of err,
+// or the $message of the requirement that wasn't met, if it has one.
+func denialReason(err error) string {
+	var failure messageError
+	if errors.As(err, &failure) {
+		// The custom $message of the requirement that wasn't met
+		return failure.message
+	}
+	switch {
+	case errors.Is(err, errNoToken):
+		return "token_missing"
+	case errors.Is(err, ErrAlgNone):
+		return "alg_none"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "token_not_yet_valid"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "token_malformed"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "signature_invalid"
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		return "token_unverifiable"
+	case errors.Is(err, jwt.ErrTokenInvalidClaims):
+		return "token_invalid"
+	default:
+		// Anything else is a failure to meet the configured requirements
+		return "claims_invalid"
+	}
+}
+
+// validate is the entry point for the validation process.
+// It validates the request and returns the HTTP status code and an error if the request is not valid (i.e. if not http.StatusOK).
+// It also sets any headers that should be forwarded to the backend in headers, as this is where we have the claims at hand.
+// A token that can't be trusted (missing, malformed, or with a bad signature or unknown key) is http.StatusUnauthorized,
+// as is one with a valid signature that has expired, which is a staleTokenError as the client may refresh it.
+// One with a valid signature that isn't valid yet is notYetValidStatus, if set, as the client need only wait.
+// A token with a valid signature that fails authorization is http.StatusForbidden, unless stale (see allowRefresh).
+// authenticated reports whether the request was allowed on a valid token, rather than without one.
+func (plugin *JWTPlugin) validate(request *http.Request, headers http.Header, variables *TemplateVariables) (status int, authenticated bool, err error) {
+	if plugin.unauthenticatedMethods.Contains(request.Method) {
+		if len(plugin.signHeaders) != 0 {
+			headers.Del(signatureHeader) // A client mustn't be able to pass off its own signature
+		}
+		return http.StatusOK, false, nil
+	}
+
+	if name, ok := plugin.trustedClientCert(request); ok {
+		// Service-to-service calls are trusted on their certificate, but mustn't be able to pass off claims of their own
+		requestLog(variables, "DEBUG", "allowing client certificate %s without a token\n", name)
+		plugin.removeMappedHeaders(headers)
+		return http.StatusOK, false, nil
+	}
+
+	err = plugin.verifyState(request)
+	if err != nil {
+		return http.StatusUnauthorized, false, err
+	}
+
+	tokens, err := plugin.extractTokens(request)
+	if err != nil {
+		return http.StatusUnauthorized, false, err
+	}
+	if len(tokens) == 0 {
+		// No token provided
+		if !plugin.isOptional(request.Method) {
+			return http.StatusUnauthorized, false, errNoToken
+		}
+
+		plugin.removeMappedHeaders(headers)
+	} else {
+		// Token(s) provided: the first valid one is used, otherwise the first's failure is reported
+		status, err = validateTokens(tokens, variables, func(token string, variables *TemplateVariables) (int, error) {
+			return plugin.validateCached(request, token, headers, variables)
+		})
+		return status, err == nil, err
+	}
+
+	return http.StatusOK, false, nil
+}
+
+// validateTokens validates each of the tokens in turn with validate until one is valid, returning its result, or otherwise
+// that of the first. Each token after the first is validated with its own copy of the variables, so that nothing set for
+// one token, such as a claim reference, can satisfy a requirement of another. The variables are left as the result's.
+func validateTokens(tokens []string, variables *TemplateVariables, validate func(string, *TemplateVariables) (int, error)) (int, error) {
+	if len(tokens) == 1 {
+		return validate(tokens[0], variables)
+	}
+	initial := make(TemplateVariables, len(*variables))
+	for key, value := range *variables {
+		initial[key] = value
+	}
+	status, err := validate(tokens[0], variables)
+	for _, token := range tokens[1:] {
+		if err == nil {
+			break
+		}
+		attempt := make(TemplateVariables, len(initial))
+		for key, value := range initial {
+			attempt[key] = value
+		}
+		if other, otherErr := validate(token, &attempt); otherErr == nil {
+			status, err, *variables = other, nil, attempt
+		}
+	}
+	return status, err
+}
+
+// validateCached validates the token, as validateToken does, using the decision cache, if enabled. It isn't used with
+// an authzURL, as its decisions may change at any time, and are cached for authzCacheDuration by authorize.
+func (plugin *JWTPlugin) validateCached(request *http.Request, token string, headers http.Header, variables *TemplateVariables) (int, error) {
+	if plugin.decisionCache == nil || plugin.authzURL != "" {
+		status, _, err := plugin.validateToken(request, token, headers, variables)
+		return status, err
+	}
+	key := decisionCacheKey(token, variables)
+	if decision, ok := plugin.decisionCache.get(key); ok {
+		return plugin.applyDecision(decision, headers)
+	}
+	status, parsed, err := plugin.validateToken(request, token, headers, variables)
+	if parsed != nil {
+		decision := &cachedDecision{status: status, err: err}
+		if err == nil {
+			decision.claims, _ = plugin.payloadClaims(parsed)
+			decision.raw = parsed.Raw
+		}
+		expiry, _ := parsed.Claims.GetExpirationTime()
+		plugin.decisionCache.set(key, decision, expiry)
+	}
+	return status, err
+}
+
+// validateToken validates the raw token presented with the request, as validate does, and sets any headers to forward.
+// It also returns the token if the decision may be cached, i.e. if it will remain the same for the same token and request
+// until the token expires, or nil if it may not.
+func (plugin *JWTPlugin) validateToken(request *http.Request, raw string, headers http.Header, variables *TemplateVariables) (int, *jwt.Token, error) {
+	keyFunc := func(token *jwt.Token) (any, error) { return plugin.getKey(token, variables) }
+	token, err := plugin.parser.Parse(raw, keyFunc)
+	if err != nil && plugin.refetchAfterSignatureFailure(token, err, variables) {
+		// The issuer may have rotated the key without changing its kid, so try again with the refreshed keys
+		token, err = plugin.parser.Parse(token.Raw, keyFunc)
+	}
+	traceToken(token, variables)
+	if err != nil {
+		if token != nil && isAlgNone(token.Header["alg"]) {
+			requestLog(variables, "WARN", "rejected token with alg none from %s", request.RemoteAddr)
+			return http.StatusUnauthorized, nil, ErrAlgNone
+		}
+		status, err := plugin.tokenFailure(token, err)
+		return status, nil, err
+	}
+
+	if plugin.validator != nil {
+		coerceTimeClaims(token.Claims.(jwt.MapClaims))
+		err = plugin.validator.Validate(token.Claims)
+		if err != nil {
+			status, err := plugin.tokenFailure(token, fmt.Errorf("token has invalid claims: %w", err))
+			return status, nil, err
+		}
+	}
+
+	err = plugin.checkFutureIat(token.Claims)
+	if err != nil {
+		return http.StatusUnauthorized, nil, err // the token becomes valid with time
+	}
+
+	err = plugin.checkLifetime(token.Claims)
+	if err != nil {
+		return http.StatusUnauthorized, token, err
+	}
+
+	err = plugin.checkSubject(token.Claims.(jwt.MapClaims))
+	if err != nil {
+		return http.StatusUnauthorized, token, err
+	}
+
+	err = plugin.checkRevoked(token.Claims.(jwt.MapClaims))
+	if errors.Is(err, errRevocationsUnavailable) {
+		return http.StatusUnauthorized, nil, err // the list may be available for the next request
+	} else if err != nil {
+		return http.StatusUnauthorized, token, err
+	}
+
+	err = plugin.requireHeader.Validate(token.Header, variables)
+	if err != nil {
+		return http.StatusUnauthorized, token, fmt.Errorf("token header %w", err)
+	}
+
+	registered := token.Claims.(jwt.MapClaims)
+	claims, err := plugin.payloadClaims(token)
+	if err != nil {
+		return http.StatusUnauthorized, token, err
+	}
+	requirement, values := plugin.requirementFor(request), plugin.splitClaimValues(claims)
+	setClaimReferences(requirement, values, variables)
+	err = requirement.Validate(values, variables)
+	if err == nil {
+		err = plugin.checkScopes(claims)
+	}
+	if err != nil {
+		if plugin.allowRefresh(registered) {
+			return http.StatusUnauthorized, nil, staleTokenError{err} // the token becomes stale with time
+		} else {
+			return http.StatusForbidden, token, err
+		}
+	}
+
+	err = plugin.checkExactAudience(registered)
+	if err != nil {
+		return http.StatusForbidden, token, err
+	}
+
+	err = plugin.checkHostAudience(request.Host, registered)
+	if err != nil {
+		return http.StatusForbidden, token, err
+	}
+
+	err = plugin.authorize(claims, variables)
+	if err != nil {
+		return http.StatusForbidden, nil, err // the decision service has its own cache
+	}
+
+	plugin.mapClaimsToHeaders(claims, headers)
+	if plugin.forwardTokenHeader != "" {
+		headers.Set(plugin.forwardTokenHeader, token.Raw)
+	}
+	return http.StatusOK, token, nil
+}
+
+// newParser creates the token parser for the configuration. If lenientTimeClaims is set, the parser doesn't validate
+// the claims and a validator is also returned to validate them once the time claims have been coerced.
+func newParser(config *Config) (*jwt.Parser, *jwt.Validator) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(config.ValidMethods), jwt.WithJSONNumber()}
+	if !config.LenientTimeClaims {
+		return jwt.NewParser(options...), nil
+	}
+	return jwt.NewParser(append(options, jwt.WithoutClaimsValidation())...), jwt.NewValidator(options...)
+}
+
+// coerceTimeClaims converts any numeric string exp, nbf or iat claims, as emitted by some issuers, to numbers.
+func coerceTimeClaims(claims jwt.MapClaims) {
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		if value, ok := claims[name].(string); ok {
+			value = strings.TrimSpace(value)
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				claims[name] = json.Number(value)
+			}
+		}
+	}
+}
+
+// tokenFailure returns the status and error for a token that failed parsing or validation of its time claims.
+// The parser only validates the claims once the signature has been verified, so an expired token is known to be genuine
+// and the client may be able to refresh it rather than having to authenticate afresh. Likewise, a token that isn't valid
+// yet is genuine, and if notYetValidStatus is set, the client is told to wait until it is.
+func (plugin *JWTPlugin) tokenFailure(token *jwt.Token, err error) (int, error) {
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		return http.StatusUnauthorized, err
+	}
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return http.StatusUnauthorized, staleTokenError{err}
+	}
+	if plugin.notYetValidStatus != 0 && errors.Is(err, jwt.ErrTokenNotValidYet) && token != nil {
+		if notBefore, _ := token.Claims.GetNotBefore(); notBefore != nil {
+			return plugin.notYetValidStatus, notYetValidError{error: err, notBefore: notBefore.Time}
+		}
+	}
+	return http.StatusUnauthorized, err
+}
+
+// notYetValidError is an error for a genuine token whose nbf is in the future.
+type notYetValidError struct {
+	error
+	notBefore time.Time
+}
+
+// Unwrap returns the underlying validation error.
+func (err notYetValidError) Unwrap() error {
+	return err.error
+}
+
+// retryAfter returns the Retry-After value for the token: the whole seconds until it becomes valid, and at least 1.
+func (err notYetValidError) retryAfter() string {
+	seconds := int64(math.Ceil(time.Until(err.notBefore).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// staleTokenError is an error for a token that has expired or failed the requirements but is old enough that a refreshed token may pass.
+type staleTokenError struct {
+	error
+}
+
+// Unwrap returns the underlying expiry or requirement error.
+func (err staleTokenError) Unwrap() error {
+	return err.error
+}
+
+// refetchAfterSignatureFailure refetches the keys for the token's issuer if refetchOnSignatureFailure is set and the
+// token failed signature verification, returning true if the keys were refetched. Refetches are limited per issuer.
+func (plugin *JWTPlugin) refetchAfterSignatureFailure(token *jwt.Token, err error, variables *TemplateVariables) bool {
+	if !plugin.refetchOnSignatureFailure || token == nil || !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		return false
+	}
+	issuer, ok := plugin.tokenIssuer(token)
+	if !ok {
+		return false
+	}
+	if !plugin.isValidIssuer(issuer, variables) || !plugin.signatureRefetches.allow(issuer) {
+		return false
+	}
+	err = plugin.fetchKeys(issuer)
+	if err != nil {
+		requestLog(variables, "ERROR", "failed to refetch keys for %s after signature failure: %v", issuer, err)
+		return false
+	}
+	requestLog(variables, "INFO", "refetched keys for %s after signature failure", issuer)
+	return true
+}
+
+// isAlgNone returns true if the alg from a token header is "none", in any case.
+func isAlgNone(alg any) bool {
+	value, ok := alg.(string)
+	return ok && strings.EqualFold(value, "none")
+}
+
+// Contains returns true if the set contains the given value, ignoring case.
+func (set CaseInsensitiveSet) Contains(value string) bool {
+	if len(set) == 0 {
+		return false
+	}
+	_, found := set[strings.ToUpper(value)]
+	return found
+}
+
+// allowRefresh returns true if freshness window is configured and the token has an iat claim that is older than the freshness window.
 func (plugin *JWTPlugin) allowRefresh(claims jwt.MapClaims) bool {
 	if plugin.freshness == 0 {
 		return false
@@ -358,66 +1598,472 @@ func (plugin *JWTPlugin) allowRefresh(claims jwt.MapClaims) bool {
 	}
 
 	value, err := iat.(json.Number).Int64()
-	return err == nil && time.Now().Unix()-value > plugin.freshness
+	return err == nil && time.Since(time.Unix(value, 0)) > plugin.freshness
+}
+
+// claimsPointer returns the JSON Pointer for the claimsPath, which may be given as a pointer or in dot notation, or "" if it isn't set.
+func claimsPointer(path string) string {
+	if path == "" || strings.HasPrefix(path, "/") {
+		return path
+	}
+	keys := strings.Split(path, ".")
+	for index, key := range keys {
+		keys[index] = strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+	}
+	return "/" + strings.Join(keys, "/")
+}
+
+// payloadClaims returns the claims to validate and map to headers: those of the token or, if claimsPath is set, those of the
+// object it addresses within the token, as when a gateway wraps the claims. The registered claims, such as exp, are always
+// taken from the top level.
+func (plugin *JWTPlugin) payloadClaims(token *jwt.Token) (jwt.MapClaims, error) {
+	claims := token.Claims.(jwt.MapClaims)
+	if plugin.claimsPointer == "" {
+		return claims, nil
+	}
+	value, _ := resolvePointer(map[string]any(claims), plugin.claimsPointer)
+	payload, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("token has invalid claims: %s is not an object", plugin.claimsPointer)
+	}
+	return payload, nil
 }
 
-// mapClaimsToHeaders maps any claims to headers as specified in the headerMap configuration.
-func (plugin *JWTPlugin) mapClaimsToHeaders(claims jwt.MapClaims, request *http.Request) {
+// checkSubject returns an error if requireSubject is set and the token's sub is missing, empty or not a string,
+// as backends that key sessions on it would otherwise misbehave.
+func (plugin *JWTPlugin) checkSubject(claims jwt.MapClaims) error {
+	if !plugin.requireSubject {
+		return nil
+	}
+	value, present := claims["sub"]
+	if !present {
+		return fmt.Errorf("%w: sub is missing", jwt.ErrTokenInvalidClaims)
+	}
+	sub, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("%w: sub must be a string; got %T", jwt.ErrTokenInvalidClaims, value)
+	}
+	if strings.TrimSpace(sub) == "" {
+		return fmt.Errorf("%w: sub is empty", jwt.ErrTokenInvalidClaims)
+	}
+	return nil
+}
+
+// checkFutureIat returns an error if maxFutureIat is set and the token's iat is further than that in the future,
+// which indicates a clock problem at the issuer or a forgery.
+func (plugin *JWTPlugin) checkFutureIat(claims jwt.Claims) error {
+	if plugin.maxFutureIat == 0 {
+		return nil
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return fmt.Errorf("token has invalid claims: %w", err)
+	}
+	if iat != nil && time.Until(iat.Time) > plugin.maxFutureIat {
+		return fmt.Errorf("token has invalid claims: %w", jwt.ErrTokenUsedBeforeIssued)
+	}
+	return nil
+}
+
+// checkLifetime returns an error if maxTokenLifetime is set and the time from the token's iat to its exp is longer,
+// as an implausibly long-lived token is suspicious. Unless requireLifetimeClaims is set, tokens without both aren't checked.
+func (plugin *JWTPlugin) checkLifetime(claims jwt.Claims) error {
+	if plugin.maxTokenLifetime == 0 {
+		return nil
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return fmt.Errorf("token has invalid claims: %w", err)
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return fmt.Errorf("token has invalid claims: %w", err)
+	}
+	if iat == nil || exp == nil {
+		if plugin.requireLifetimeClaims {
+			return fmt.Errorf("%w: iat and exp are required", jwt.ErrTokenInvalidClaims)
+		}
+		return nil
+	}
+	if lifetime := exp.Sub(iat.Time); lifetime > plugin.maxTokenLifetime {
+		return fmt.Errorf("%w: lifetime of %s exceeds the maximum of %s", jwt.ErrTokenInvalidClaims, lifetime, plugin.maxTokenLifetime)
+	}
+	return nil
+}
+
+// newScopeClaims returns the configured scope claims or the default set of conventional names.
+// This isn't defaulted in CreateConfig, as configured lists are merged into, rather than replace, default lists when decoded.
+func newScopeClaims(configured []string) []string {
+	if len(configured) == 0 {
+		return []string{"scope", "scp", "scopes"}
+	}
+	return configured
+}
+
+// checkScopes returns an error if any of requireScopes is not granted by the token. Scopes are collected from all of
+// the scopeClaims present, so that the differing conventions of issuers (e.g. Azure AD's scp) are handled alike.
+func (plugin *JWTPlugin) checkScopes(claims jwt.MapClaims) error {
+	if len(plugin.requireScopes) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool)
+	for _, name := range plugin.scopeClaims {
+		switch value := claims[name].(type) {
+		case string:
+			for _, scope := range strings.Fields(value) {
+				granted[scope] = true
+			}
+		case []any:
+			for _, scope := range value {
+				if scope, ok := scope.(string); ok {
+					granted[scope] = true
+				}
+			}
+		}
+	}
+	for _, scope := range plugin.requireScopes {
+		if !granted[scope] {
+			return fmt.Errorf("scope %s is required", scope)
+		}
+	}
+	return nil
+}
+
+// hostAudience is an audience that is required for requests to hosts matching the pattern.
+type hostAudience struct {
+	pattern  string
+	audience string
+}
+
+// newHostAudience creates the list of host audiences from the configuration, ordered so that the most specific patterns are tried first:
+// exact hosts, then the longest patterns.
+func newHostAudience(config map[string]string) []hostAudience {
+	result := make([]hostAudience, 0, len(config))
+	for pattern, audience := range config {
+		result = append(result, hostAudience{pattern: strings.ToLower(pattern), audience: audience})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		wildcardI, wildcardJ := strings.ContainsAny(result[i].pattern, "*?["), strings.ContainsAny(result[j].pattern, "*?[")
+		if wildcardI != wildcardJ {
+			return wildcardJ
+		}
+		if len(result[i].pattern) != len(result[j].pattern) {
+			return len(result[i].pattern) > len(result[j].pattern)
+		}
+		return result[i].pattern < result[j].pattern
+	})
+	return result
+}
+
+// checkHostAudience returns an error if the request's host matches a hostAudience pattern and the token's aud doesn't
+// include the audience for the host.
+func (plugin *JWTPlugin) checkHostAudience(host string, claims jwt.MapClaims) error {
+	if len(plugin.hostAudience) == 0 {
+		return nil
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	for _, entry := range plugin.hostAudience {
+		if !fnmatch.Match(entry.pattern, host, 0) {
+			continue
+		}
+		audiences, err := claims.GetAudience()
+		if err == nil {
+			if plugin.exactHostAudience {
+				if sameAudiences(audiences, []string{entry.audience}) {
+					return nil
+				}
+			} else {
+				for _, audience := range audiences {
+					if audience == entry.audience {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("token audience is not valid for %s", host)
+	}
+	return nil
+}
+
+// newExactAudience returns the audiences in the require aud if exactAudience is set, or nil if not.
+// Templates aren't supported, as the set is fixed at startup.
+func newExactAudience(config *Config) ([]string, error) {
+	if !config.ExactAudience {
+		return nil, nil
+	}
+	var audiences []string
+	switch value := config.Require["aud"].(type) {
+	case string:
+		audiences = []string{value}
+	case []any:
+		for _, value := range value {
+			audience, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("exactAudience requires require aud to be a string or list of strings")
+			}
+			audiences = append(audiences, audience)
+		}
+	case nil:
+		if len(config.HostAudience) == 0 {
+			return nil, fmt.Errorf("exactAudience is set but require has no aud and there is no hostAudience")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("exactAudience requires require aud to be a string or list of strings")
+	}
+	for _, audience := range audiences {
+		if strings.Contains(audience, "{{") {
+			return nil, fmt.Errorf("exactAudience requires require aud values that aren't templates; got %s", audience)
+		}
+	}
+	return audiences, nil
+}
+
+// checkExactAudience returns an error if exactAudience is set and the token's aud isn't exactly the set of audiences in require,
+// such as a token that includes our audience but also others.
+func (plugin *JWTPlugin) checkExactAudience(claims jwt.MapClaims) error {
+	if len(plugin.exactAudience) == 0 {
+		return nil
+	}
+	audiences, err := claims.GetAudience()
+	if err != nil || !sameAudiences(audiences, plugin.exactAudience) {
+		return fmt.Errorf("token audience is not exactly %s", strings.Join(plugin.exactAudience, ","))
+	}
+	return nil
+}
+
+// sameAudiences returns true if the two lists contain the same set of audiences, regardless of order and duplicates.
+func sameAudiences(audiences []string, expected []string) bool {
+	set := make(map[string]bool, len(expected))
+	for _, audience := range expected {
+		set[audience] = false
+	}
+	for _, audience := range audiences {
+		if _, ok := set[audience]; !ok {
+			return false
+		}
+		set[audience] = true
+	}
+	for _, found := range set {
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// splitClaimValues returns the claims with any string claims named in splitClaims split into lists on their delimiter.
+// The original claims are left untouched (so that headerMap forwards them as issued) and returned as is if there is nothing to split.
+func (plugin *JWTPlugin) splitClaimValues(claims jwt.MapClaims) map[string]any {
+	if len(plugin.splitClaims) == 0 {
+		return claims
+	}
+	result := make(map[string]any, len(claims))
+	for claim, value := range claims {
+		result[claim] = value
+	}
+	for claim, delimiter := range plugin.splitClaims {
+		value, ok := claims[claim].(string)
+		if !ok {
+			continue
+		}
+		if delimiter == "" {
+			delimiter = ","
+		}
+		values := make([]any, 0)
+		for _, part := range strings.Split(value, delimiter) {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				values = append(values, part)
+			}
+		}
+		result[claim] = values
+	}
+	return result
+}
+
+// mapClaimsToHeaders maps any claims to headers as specified in the headerMap configuration and sets any constant setHeaders.
+func (plugin *JWTPlugin) mapClaimsToHeaders(claims jwt.MapClaims, headers http.Header) {
+	var marshalled map[string]string // claim -> JSON, so that a large claim mapped to several headers is only marshalled once
 	for header, claim := range plugin.headerMap {
 		value, ok := claims[claim]
 		if ok {
-			request.Header.Del(header)
+			// Any existing values, e.g. from the client or an earlier pass over the same request, are replaced rather than appended to
+			headers.Del(header)
 			switch value := value.(type) {
 			case []any, map[string]any, nil:
-				json, err := json.Marshal(value)
-				if err == nil {
-					request.Header.Add(header, string(json))
+				encoded, ok := marshalled[claim]
+				if !ok {
+					json, err := json.Marshal(value)
+					if err != nil {
+						// Although we check err, we don't have a branch to log an error for err != nil, because it's not possible
+						// that the value won't be marshallable to json, given it has already been unmarshalled _from_ json to get here
+						continue
+					}
+					if marshalled == nil {
+						marshalled = make(map[string]string, len(plugin.headerMap))
+					}
+					encoded = string(json)
+					marshalled[claim] = encoded
 				}
-				// Although we check err, we don't have a branch to log an error for err != nil, because it's not possible
-				// that the value won't be marshallable to json, given it has already been unmarshalled _from_ json to get here
+				headers.Set(header, encoded)
+			case json.Number:
+				// Claims are parsed with WithJSONNumber, so this is the number exactly as it appeared in the token
+				headers.Set(header, value.String())
+			case float64:
+				// Never reached for parsed tokens, but avoid fmt's exponent form (1e+06) should one ever get here
+				headers.Set(header, strconv.FormatFloat(value, 'f', -1, 64))
 			default:
-				request.Header.Add(header, fmt.Sprint(value))
+				headers.Set(header, fmt.Sprint(value))
 			}
 		} else if plugin.removeMissingHeaders {
-			request.Header.Del(header)
+			headers.Del(header)
+		}
+	}
+	if plugin.subjectHeader != "" {
+		headers.Del(plugin.subjectHeader)
+		if subject := plugin.subject(claims); subject != "" {
+			headers.Set(plugin.subjectHeader, subject)
+		}
+	}
+	for header, value := range plugin.setHeaders {
+		headers.Set(header, value)
+	}
+	plugin.signMappedHeaders(headers)
+}
+
+// newSubjectClaims returns the configured subject claims or the default of sub then email.
+// As with scopeClaims, the default can't be set in CreateConfig.
+func newSubjectClaims(configured []string) []string {
+	if len(configured) == 0 {
+		return []string{"sub", "email"}
+	}
+	return configured
+}
+
+// subject returns the value of the first of subjectClaims that is a non-empty string, or "" if there is none.
+func (plugin *JWTPlugin) subject(claims jwt.MapClaims) string {
+	for _, claim := range plugin.subjectClaims {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			return value
 		}
 	}
+	return ""
 }
 
-// removeMappedHeaders arbitrarily removes all target headers named in the headerMap from the request.
-func (plugin *JWTPlugin) removeMappedHeaders(request *http.Request) {
+// signatureHeader is the header in which the HMAC of the mapped headers is sent when signHeaders is set.
+const signatureHeader = "X-Auth-Signature"
+
+// signMappedHeaders sets signatureHeader to the hex encoded HMAC-SHA256, keyed with signHeaders, of the canonicalized headerMap and
+// setHeaders headers, so that the backend can verify that they were set by us and not by the client. The canonical form is, for
+// each of the configured header names, lowercased and sorted, a line "name:value\n", where value is the header's values joined
+// with "," or empty if the header is absent.
+func (plugin *JWTPlugin) signMappedHeaders(headers http.Header) {
+	if len(plugin.signHeaders) == 0 {
+		return
+	}
+	names := make([]string, 0, len(plugin.headerMap)+len(plugin.setHeaders))
 	for header := range plugin.headerMap {
-		request.Header.Del(header)
+		names = append(names, strings.ToLower(header))
+	}
+	for header := range plugin.setHeaders {
+		names = append(names, strings.ToLower(header))
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, plugin.signHeaders)
+	previous := ""
+	for _, name := range names {
+		if name == previous {
+			continue // The same header in both headerMap and setHeaders
+		}
+		previous = name
+		fmt.Fprintf(mac, "%s:%s\n", name, strings.Join(headers.Values(name), ","))
+	}
+	headers.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// removeMappedHeaders arbitrarily removes all target headers named in the headerMap and setHeaders, and any forwardTokenHeader
+// and renameTokenHeader, from headers.
+func (plugin *JWTPlugin) removeMappedHeaders(headers http.Header) {
+	for header := range plugin.headerMap {
+		headers.Del(header)
+	}
+	for header := range plugin.setHeaders {
+		headers.Del(header)
+	}
+	if plugin.forwardTokenHeader != "" {
+		headers.Del(plugin.forwardTokenHeader)
+	}
+	if plugin.renameTokenHeader != "" {
+		headers.Del(plugin.renameTokenHeader)
+	}
+	if len(plugin.signHeaders) != 0 {
+		headers.Del(signatureHeader)
+	}
+	if plugin.subjectHeader != "" {
+		headers.Del(plugin.subjectHeader)
 	}
 }
 
 // getKey gets the key for the given key ID from the plugin's key cache.
 // If the key isn't present and the iss is valid according to the plugin's configuration, all keys for the iss are refreshed and the key is looked up again.
-func (plugin *JWTPlugin) getKey(token *jwt.Token) (any, error) {
+func (plugin *JWTPlugin) getKey(token *jwt.Token, variables *TemplateVariables) (any, error) {
+	// A non-string iss must not be allowed to skip issuer validation and fall through to the fixed secret below
+	if iss, ok := token.Claims.(jwt.MapClaims)["iss"]; ok {
+		if _, ok := iss.(string); !ok {
+			return nil, fmt.Errorf("iss claim must be a string; got %T", iss)
+		}
+	}
+
+	// If issuers are derived from the request, a token from one tenant must not be accepted for another, even if we already hold its key
+	if len(plugin.issuerTemplates) > 0 {
+		if issuer, ok := token.Claims.(jwt.MapClaims)["iss"].(string); ok && !plugin.isValidIssuer(canonicalizeDomain(issuer), variables) {
+			return nil, fmt.Errorf("issuer %s is not valid", issuer)
+		}
+	}
+
 	err := fmt.Errorf("no secret configured")
-	if len(plugin.issuers) > 0 || len(plugin.keys) > 0 {
-		kid, ok := token.Header["kid"]
+	if len(plugin.issuers) > 0 || len(plugin.issuerTemplates) > 0 || plugin.hasInternalKeys() {
+		kid, ok := keyID(token.Header["kid"])
+		if !ok {
+			// Fall back to the certificate thumbprint if the token doesn't reference the key by kid
+			kid, ok = keyID(token.Header["x5t"])
+		}
 		if ok {
+			if plugin.normalizeKid {
+				kid = normalizeKid(kid, variables)
+			}
+			issuer, hasIssuer := plugin.tokenIssuer(token)
+			if !hasIssuer && len(plugin.issuerTemplates) > 0 {
+				// Without an issuer, any tenant's key would do, so only keys configured in secrets are considered
+				issuer = internalIssuer
+			}
 			refreshed := ""
 			for looped := false; ; looped = true {
-				plugin.lock.RLock()
-				key, ok := plugin.keys[kid.(string)]
-				plugin.lock.RUnlock()
+				key, ok := plugin.lookupKey(issuer, kid)
 				if ok {
 					return key, nil
 				}
 
 				if looped {
 					if refreshed != "" {
-						logger.Log("WARN", "key %s: refreshed keys from %s and still no match", kid, refreshed)
+						requestLog(variables, "WARN", "key %s: refreshed keys from %s and still no match", kid, refreshed)
+						if plugin.unknownKids != nil {
+							plugin.unknownKids.add(issuer, kid)
+						}
 					}
 					break
 				}
 
-				issuer, ok := token.Claims.(jwt.MapClaims)["iss"].(string)
-				if ok {
-					issuer = canonicalizeDomain(issuer)
-					if plugin.isValidIssuer(issuer) {
+				if hasIssuer {
+					if plugin.unknownKids != nil && plugin.unknownKids.contains(issuer, kid) {
+						// Don't let tokens presenting a kid the issuer doesn't have cause a refetch for every request
+						err = fmt.Errorf("key %s is not known to issuer %s", kid, issuer)
+					} else if plugin.isValidIssuer(issuer, variables) {
 						// There is a design choice here: we have determined that the key is not present whilst holding the read lock.
 						// fetchKeys will fetch the metadata and key from the issuer before it aquires the write lock, as we don't want
 						// to block other requests that are able to immediately read available keys.
@@ -427,7 +2073,7 @@ func (plugin *JWTPlugin) getKey(token *jwt.Token) (any, error) {
 						if err == nil {
 							refreshed = issuer
 						} else {
-							log.Printf("failed to fetch keys for %s: %v", issuer, err)
+							requestLog(variables, "ERROR", "failed to fetch keys for %s: %v", issuer, err)
 						}
 					} else {
 						err = fmt.Errorf("issuer %s is not valid", issuer)
@@ -439,7 +2085,14 @@ func (plugin *JWTPlugin) getKey(token *jwt.Token) (any, error) {
 		}
 	}
 
-	// We fall back to any fixed secret or return the error
+	// We fall back to any wildcard secret, then any secrets bundle, then any fixed secret, or return the error
+	if plugin.wildcardSecret != nil {
+		return plugin.wildcardSecret, nil
+	}
+	if len(plugin.secretsBundle) > 0 && token.Header["kid"] == nil && token.Header["x5t"] == nil {
+		// Tokens without a kid may be verified by any of the keys in the bundle
+		return jwt.VerificationKeySet{Keys: plugin.secretsBundle}, nil
+	}
 	if plugin.secret == nil {
 		return nil, err
 	}
@@ -447,13 +2100,101 @@ func (plugin *JWTPlugin) getKey(token *jwt.Token) (any, error) {
 	return plugin.secret, nil
 }
 
+// normalizeKid returns the kid with any surrounding whitespace removed and any percent-encoding decoded, so that it matches
+// the issuer's kid byte-for-byte rather than causing repeated refetches. Any change is logged, as it indicates a misbehaving client or issuer.
+func normalizeKid(original string, variables *TemplateVariables) string {
+	normalized := strings.TrimSpace(original)
+	if unescaped, err := url.PathUnescape(normalized); err == nil {
+		normalized = strings.TrimSpace(unescaped)
+	}
+	if normalized != original {
+		requestLog(variables, "WARN", "normalized token kid %q to %q", original, normalized)
+	}
+	return normalized
+}
+
+// keyID returns the string form of a kid (or x5t) from the token header. Some non-compliant issuers emit the kid as a JSON number,
+// which the header decodes as a float64; it is formatted without an exponent so that it matches the kid indexed from the JWKS.
+func keyID(kid any) (string, bool) {
+	switch kid := kid.(type) {
+	case string:
+		return kid, true
+	case float64:
+		return strconv.FormatFloat(kid, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// tokenIssuer returns the token's canonicalized iss, or the defaultIssuer if the token has no iss.
+// It returns false if there is neither.
+func (plugin *JWTPlugin) tokenIssuer(token *jwt.Token) (string, bool) {
+	issuer, ok := token.Claims.(jwt.MapClaims)["iss"].(string)
+	if ok {
+		return canonicalizeDomain(issuer), true
+	}
+	if plugin.defaultIssuer != "" {
+		return plugin.defaultIssuer, true
+	}
+	return "", false
+}
+
+// lookupKey returns the key for the given key ID. If the token has an issuer, only keys fetched from that issuer or
+// configured in secrets are considered, so that one issuer's key can't shadow another's with the same kid.
+// Without an issuer, the key configured in secrets is used, or otherwise that of the only issuer that has the kid.
+func (plugin *JWTPlugin) lookupKey(issuer string, kid string) (any, bool) {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	if plugin.isExpiredKey(issuer, kid, time.Now()) {
+		return nil, false // so that the caller refetches the issuer's keys, which drops the key
+	}
+	if issuer != "" {
+		if key, ok := plugin.issuerKeys[issuer][kid]; ok {
+			return key, true
+		}
+	}
+	if key, ok := plugin.issuerKeys[internalIssuer][kid]; ok || issuer != "" {
+		return key, ok
+	}
+	var found any
+	issuers := 0
+	for _, keys := range plugin.issuerKeys {
+		if key, ok := keys[kid]; ok {
+			found = key
+			issuers++
+		}
+	}
+	if issuers > 1 {
+		// We can't tell which issuer's key is meant, and the last fetched mustn't win
+		logger.Log("DEBUG", "key:%s is held by %d issuers, so can't be used for a token without iss", kid, issuers)
+	}
+	return found, issuers == 1
+}
+
+// hasInternalKeys returns true if any keys are configured in secrets or inlineJWKS.
+func (plugin *JWTPlugin) hasInternalKeys() bool {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	return len(plugin.issuerKeys[internalIssuer]) > 0
+}
+
 // isValidIssuer returns true if the issuer is allowed by the Issers configuration.
-func (plugin *JWTPlugin) isValidIssuer(issuer string) bool {
+// Issuer templates are expanded for the request and must match exactly.
+func (plugin *JWTPlugin) isValidIssuer(issuer string, variables *TemplateVariables) bool {
 	for _, allowed := range plugin.issuers {
 		if fnmatch.Match(allowed, issuer, 0) {
 			return true
 		}
 	}
+	for _, issuerTemplate := range plugin.issuerTemplates {
+		allowed, err := expandTemplate(issuerTemplate, variables)
+		if err != nil {
+			requestLog(variables, "ERROR", "failed to expand issuer template: %v", err)
+			continue
+		}
+		if canonicalizeDomain(allowed) == issuer {
+			return true
+		}
+	}
 	return false
 }
 
@@ -468,18 +2209,35 @@ func hostname(address string) string {
 }
 
 // clientForURL returns the http.Client for the given URL, or the default client if no specific client is configured.
+// A client configured for the URL's host:port takes precedence over one for its hostname alone.
 func (plugin *JWTPlugin) clientForURL(address string) *http.Client {
+	if parsed, err := url.Parse(address); err == nil && parsed.Hostname() != "" {
+		if client, ok := plugin.clients[hostPort(parsed)]; ok {
+			return client
+		}
+	}
 	client, ok := plugin.clients[hostname(address)]
 	if ok {
 		return client
+	} else if client, ok := plugin.clients[wildcardHost]; ok {
+		return client
 	} else {
 		return plugin.defaultClient
 	}
 }
 
+// fetchOptions returns the options for fetching OpenID configurations and keys from issuers.
+func (plugin *JWTPlugin) fetchOptions() FetchOptions {
+	return FetchOptions{UserAgent: plugin.userAgent, MaxBytes: plugin.maxJWKSBytes, RejectPrivate: plugin.rejectPrivateJWKS}
+}
+
 // fetchAllKeys fetches all keys for all issuers in the plugin's configuration.
+// If lazyIssuers is set, only issuers whose keys have already been fetched on demand are refreshed.
 func (plugin *JWTPlugin) fetchAllKeys() {
 	for _, issuer := range plugin.issuers {
+		if plugin.lazyIssuers && !plugin.isSeenIssuer(issuer) {
+			continue
+		}
 		if !strings.Contains(issuer, "*") {
 			err := plugin.fetchKeys(issuer)
 			if err != nil {
@@ -489,84 +2247,417 @@ func (plugin *JWTPlugin) fetchAllKeys() {
 	}
 }
 
-// fetchKeys fetches the keys from the well-known or custom jwks endpoint for the given issuer and adds them to the key map.
-func (plugin *JWTPlugin) fetchKeys(issuer string) error {
-	url, ok := plugin.issuerJWKSEndpoints[issuer]
-	if !ok {
-		configURL := issuer + ".well-known/openid-configuration" // issuer has trailing slash
-		config, err := FetchOpenIDConfiguration(configURL, plugin.clientForURL(configURL))
+// isSeenIssuer returns true if keys have been fetched for the issuer.
+func (plugin *JWTPlugin) isSeenIssuer(issuer string) bool {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	_, ok := plugin.issuerKeys[issuer]
+	return ok
+}
+
+// fetchKeys fetches the keys for the given issuer from the plugin's KeySource and adds them to the key map.
+func (plugin *JWTPlugin) fetchKeys(issuer string) error {
+	if plugin.fetchBreaker != nil {
+		// Fail fast, and keep serving any cached keys, rather than waiting on an issuer that keeps failing
+		err := plugin.fetchBreaker.allow(issuer)
+		if err != nil {
+			return err
+		}
+	}
+	jwks, err := plugin.KeySource().KeysForIssuer(issuer)
+	if plugin.fetchBreaker != nil {
+		plugin.fetchBreaker.record(issuer, err)
+	}
+	if err != nil {
+		return err
+	}
+	for keyID, key := range jwks {
+		err := checkRSABits(key, plugin.minRSABits)
+		if err != nil {
+			logger.Log("WARN", "ignoring kid:%s from issuer:%s: %v", keyID, issuer, err)
+			delete(jwks, keyID)
+		}
+	}
+
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
+	now := time.Now()
+	info := make(map[string]KeyInfo, len(jwks))
+	for keyID, key := range jwks {
+		logger.Log("INFO", "fetched key:%s for issuer:%s", keyID, issuer)
+		info[keyID] = KeyInfo{Kid: keyID, Alg: keyAlgorithm(key), Issuer: issuer, FetchedAt: now}
+	}
+
+	plugin.retainKeys(issuer, jwks, now)
+	for keyID := range jwks {
+		if _, ok := info[keyID]; !ok {
+			info[keyID] = plugin.keyInfo[issuer][keyID] // retained from before
+		}
+	}
+	for keyID := range plugin.issuerKeys[issuer] {
+		if _, ok := jwks[keyID]; !ok {
+			logger.Log("INFO", "key:%s for issuer:%s dropped", keyID, issuer)
+		}
+	}
+	plugin.issuerKeys[issuer] = jwks
+	plugin.keyInfo[issuer] = info
+	plugin.invalidateDecisions() // so that tokens signed by keys that have gone are no longer allowed
+	if plugin.unknownKids != nil {
+		// Kids introduced by a key rotation must be usable immediately, not once their unknown entries expire
+		plugin.unknownKids.remove(issuer, jwks)
+	}
+
+	return nil
+}
+
+// retainKeys adds the issuer's previous keys that are missing from the newly fetched jwks back into it until keyRetention
+// has elapsed since they were first found to be missing, so that tokens signed before a key rotation remain valid.
+// The plugin's write lock must be held.
+func (plugin *JWTPlugin) retainKeys(issuer string, jwks map[string]any, now time.Time) {
+	if plugin.keyRetention == 0 {
+		return
+	}
+	retired := plugin.retiredKeys[issuer]
+	if retired == nil {
+		retired = make(map[string]time.Time)
+		plugin.retiredKeys[issuer] = retired
+	}
+	for keyID := range jwks {
+		delete(retired, keyID) // the key is back in the JWKS (or was never retired)
+	}
+	for keyID, key := range plugin.issuerKeys[issuer] {
+		if _, ok := jwks[keyID]; ok {
+			continue
+		}
+		expires, ok := retired[keyID]
+		if !ok {
+			expires = now.Add(plugin.keyRetention)
+			retired[keyID] = expires
+			logger.Log("INFO", "key:%s retained until %s", keyID, expires.Format(time.RFC3339))
+		}
+		if now.Before(expires) {
+			jwks[keyID] = key
+		} else {
+			delete(retired, keyID)
+		}
+	}
+}
+
+// isExpiredKey returns true if the key has been retained after removal from the issuer's JWKS and its retention has
+// elapsed. If issuer is empty, the key is expired if it is expired for any issuer. The plugin's read lock must be held.
+func (plugin *JWTPlugin) isExpiredKey(issuer string, keyID string, now time.Time) bool {
+	if issuer != "" {
+		expires, ok := plugin.retiredKeys[issuer][keyID]
+		return ok && !now.Before(expires)
+	}
+	for _, retired := range plugin.retiredKeys {
+		if expires, ok := retired[keyID]; ok && !now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchOpenIDConfiguration returns the OpenID configuration from the discovery cache, if enabled, or fetches it.
+func (plugin *JWTPlugin) fetchOpenIDConfiguration(configURL string) (*OpenIDConfiguration, error) {
+	if plugin.discoveryCache != nil {
+		if config := plugin.discoveryCache.get(configURL); config != nil {
+			return config, nil
+		}
+	}
+	config, err := FetchOpenIDConfigurationWithOptions(configURL, plugin.clientForURL(configURL), plugin.fetchOptions())
+	if err != nil {
+		return nil, err
+	}
+	logger.Log("INFO", "fetched openid-configuration from url:%s", configURL)
+	if plugin.discoveryCache != nil {
+		plugin.discoveryCache.set(configURL, config)
+	}
+	return config, nil
+}
+
+// signatureRefetchInterval is the minimum interval between refetches of an issuer's keys after signature failures.
+const signatureRefetchInterval = time.Minute
+
+// refetchLimiter limits how often each issuer's keys may be refetched.
+type refetchLimiter struct {
+	lock     sync.Mutex
+	last     map[string]time.Time
+	interval time.Duration
+}
+
+// newRefetchLimiter creates a limiter allowing one refetch per issuer in each interval.
+func newRefetchLimiter(interval time.Duration) *refetchLimiter {
+	return &refetchLimiter{last: make(map[string]time.Time), interval: interval}
+}
+
+// allow returns true, and records the refetch, if the issuer's keys haven't been refetched within the interval.
+func (limiter *refetchLimiter) allow(issuer string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	if last, ok := limiter.last[issuer]; ok && now.Sub(last) < limiter.interval {
+		return false
+	}
+	limiter.last[issuer] = now
+	return true
+}
+
+// circuitBreaker suppresses fetches from each issuer for a cooldown period once it has failed a number of times in a row,
+// so that an issuer that is down doesn't cost every request that presents an unknown kid a full timeout.
+// Once the cooldown has elapsed, a single fetch is allowed to probe the issuer, and if that also fails, the breaker opens again.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  map[string]int       // The number of consecutive failed fetches from each issuer
+	openUntil map[string]time.Time // The end of the cooldown of each issuer whose breaker is open
+	threshold int
+	cooldown  time.Duration
+}
 
-		if err != nil {
-			// Fall back to direct JWKS URL if OpenID configuration fetch fails
-			url = issuer + ".well-known/jwks.json"
-			logger.Log("WARN", "failed to fetch openid-configuration from url:%s; falling back to direct JWKS URL:%s", configURL, url)
-		} else {
-			logger.Log("INFO", "fetched openid-configuration from url:%s", configURL)
-			url = config.JWKSURI
-		}
+// newCircuitBreaker creates a breaker that opens after threshold consecutive failures, or nil if threshold is 0.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold == 0 {
+		return nil
 	}
+	return &circuitBreaker{failures: make(map[string]int), openUntil: make(map[string]time.Time), threshold: threshold, cooldown: cooldown}
+}
 
-	jwks, err := FetchJWKS(url, plugin.clientForURL(url))
-	if err != nil {
-		return err
+// allow returns nil if keys may be fetched from the issuer, or an error if its breaker is open.
+func (breaker *circuitBreaker) allow(issuer string) error {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if until, ok := breaker.openUntil[issuer]; ok && time.Now().Before(until) {
+		return fmt.Errorf("not fetching keys for %s after %d consecutive failures until %s", issuer, breaker.failures[issuer], until.Format(time.RFC3339))
 	}
+	return nil
+}
 
-	plugin.lock.Lock()
-	defer plugin.lock.Unlock()
+// record records the result of a fetch from the issuer, opening its breaker if it has now failed threshold times in a row.
+func (breaker *circuitBreaker) record(issuer string, err error) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if err == nil {
+		if _, ok := breaker.openUntil[issuer]; ok {
+			logger.Log("INFO", "fetched keys for %s again; closing its circuit breaker", issuer)
+		}
+		delete(breaker.failures, issuer)
+		delete(breaker.openUntil, issuer)
+		return
+	}
+	breaker.failures[issuer]++
+	if breaker.failures[issuer] >= breaker.threshold {
+		until := time.Now().Add(breaker.cooldown)
+		breaker.openUntil[issuer] = until
+		logger.Log("WARN", "fetching keys for %s failed %d times in a row; suppressing fetches until %s", issuer, breaker.failures[issuer], until.Format(time.RFC3339))
+	}
+}
 
-	for keyID, key := range jwks {
-		logger.Log("INFO", "fetched key:%s from url:%s", keyID, url)
-		plugin.keys[keyID] = key
+// unknownKidCache remembers, for a limited time, the kids that issuers were found not to have.
+type unknownKidCache struct {
+	lock      sync.Mutex
+	entries   map[string]time.Time // The expiry of each issuer and kid pair
+	duration  time.Duration
+	sweepSize int // The size at which we sweep expired entries on insertion
+}
+
+// newUnknownKidCache creates a cache holding unknown kids for the given duration, or nil if the duration is 0.
+func newUnknownKidCache(duration time.Duration) *unknownKidCache {
+	if duration == 0 {
+		return nil
 	}
+	return &unknownKidCache{entries: make(map[string]time.Time), duration: duration, sweepSize: 1024}
+}
 
-	plugin.issuerKeys[url] = jwks
-	plugin.purgeKeys()
+// unknownKidKey returns the cache key for the issuer and kid.
+func unknownKidKey(issuer string, kid string) string {
+	return issuer + "\x00" + kid
+}
 
-	return nil
+// contains returns true if the kid was recently found to be unknown to the issuer.
+func (cache *unknownKidCache) contains(issuer string, kid string) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	expires, ok := cache.entries[unknownKidKey(issuer, kid)]
+	return ok && time.Now().Before(expires)
 }
 
-// isIssuedKey returns true if the key exists in the issuerKeys map
-func (plugin *JWTPlugin) isIssuedKey(keyID string) bool {
-	for _, issuerKeys := range plugin.issuerKeys {
-		if _, ok := issuerKeys[keyID]; ok {
-			return true
+// add records the kid as unknown to the issuer, sweeping out any expired entries if the cache has grown large.
+func (cache *unknownKidCache) add(issuer string, kid string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	if len(cache.entries) >= cache.sweepSize {
+		for key, expires := range cache.entries {
+			if now.After(expires) {
+				delete(cache.entries, key)
+			}
 		}
 	}
-	return false
+	cache.entries[unknownKidKey(issuer, kid)] = now.Add(cache.duration)
 }
 
-// purgeKeys purges all keys from plugin.keys that are not in the issuerKeys map.
-func (plugin *JWTPlugin) purgeKeys() {
-	for keyID := range plugin.keys {
-		if !plugin.isIssuedKey(keyID) {
-			logger.Log("INFO", "key:%s dropped", keyID)
-			delete(plugin.keys, keyID)
+// remove removes the entries for any of the kids that the issuer now has.
+func (cache *unknownKidCache) remove(issuer string, kids map[string]any) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for kid := range kids {
+		delete(cache.entries, unknownKidKey(issuer, kid))
+	}
+}
+
+// Keys returns a description of each key currently held by the plugin, by key ID, for tooling and tests.
+// Where more than one issuer has the same key ID, each of those keys is instead given by its issuer, a space and the key ID.
+// The key material itself is not exposed.
+func (plugin *JWTPlugin) Keys() map[string]KeyInfo {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	issuers := make(map[string]int)
+	for _, infos := range plugin.keyInfo {
+		for keyID := range infos {
+			issuers[keyID]++
+		}
+	}
+	keys := make(map[string]KeyInfo, len(issuers))
+	for issuer, infos := range plugin.keyInfo {
+		for keyID, info := range infos {
+			if issuers[keyID] > 1 {
+				keys[issuer+" "+keyID] = info
+			} else {
+				keys[keyID] = info
+			}
 		}
 	}
+	return keys
+}
+
+// keyAlgorithm returns the algorithm family that the given key can be used with.
+func keyAlgorithm(key any) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "EC " + key.Curve.Params().Name
+	case []byte:
+		return "HMAC"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
 }
 
-// parseIssuers splits a mixed []any issuers list into a flat []string of canonicalized issuer names
-// and a map of issuer name -> hard-coded JWKS endpoint for entries that specify one.
-func parseIssuers(raw []any) ([]string, map[string]string, error) {
+// parseIssuers splits a mixed []any issuers list into a flat []string of canonicalized issuer names,
+// a map of issuer name -> hard-coded JWKS endpoint for entries that specify one, a map of issuer name -> key format
+// for entries that aren't JWKS, and a map of issuer name -> additional JWKS endpoints for entries that specify them.
+func parseIssuers(raw []any) ([]string, map[string]string, map[string]string, map[string][]string, error) {
 	issuers := make([]string, 0, len(raw))
 	endpoints := make(map[string]string)
+	formats := make(map[string]string)
+	additional := make(map[string][]string)
 	for _, entry := range raw {
 		switch value := entry.(type) {
 		case string:
-			issuers = append(issuers, canonicalizeDomain(value))
+			if !strings.Contains(value, "{{") {
+				value = canonicalizeDomain(value) // templates are canonicalized after expansion
+			}
+			issuers = append(issuers, value)
 		case map[string]any:
 			issuer, ok := value["issuer"].(string)
 			if !ok || issuer == "" {
-				return nil, nil, fmt.Errorf("issuer map entry is missing a valid \"issuer\" key")
+				return nil, nil, nil, nil, fmt.Errorf("issuer map entry is missing a valid \"issuer\" key")
 			}
 			issuer = canonicalizeDomain(issuer)
 			issuers = append(issuers, issuer)
-			if jwks, ok := value["jwks"].(string); ok && jwks != "" {
+			jwks, _ := value["jwks"].(string)
+			if jwks != "" {
 				endpoints[issuer] = jwks
 			}
+			if format, ok := value["format"].(string); ok && format != "" && format != keysFormatJWKS {
+				if format != keysFormatPEM {
+					return nil, nil, nil, nil, fmt.Errorf("issuer %s has unknown format %q", issuer, format)
+				}
+				if jwks == "" {
+					return nil, nil, nil, nil, fmt.Errorf("issuer %s with format %q requires jwks", issuer, format)
+				}
+				formats[issuer] = format
+			}
+			if urls, ok := value["additionalJWKSURLs"]; ok {
+				list, ok := urls.([]any)
+				if !ok {
+					return nil, nil, nil, nil, fmt.Errorf("issuer %s additionalJWKSURLs must be a list of URLs", issuer)
+				}
+				for _, endpoint := range list {
+					endpoint, ok := endpoint.(string)
+					if !ok || endpoint == "" {
+						return nil, nil, nil, nil, fmt.Errorf("issuer %s additionalJWKSURLs must be a list of URLs", issuer)
+					}
+					additional[issuer] = append(additional[issuer], endpoint)
+				}
+			}
+		}
+	}
+	return issuers, endpoints, formats, additional, nil
+}
+
+// validateIssuers checks that each static issuer is an absolute URL, as keys are fetched from URLs derived from it,
+// and, if requireTLS is set, that neither it nor any hard-coded or additional JWKS endpoint is a plaintext URL.
+// Wildcard issuers are only ever matched against, never fetched from, so aren't checked.
+func validateIssuers(issuers []string, endpoints map[string]string, additional map[string][]string, requireTLS bool) error {
+	for _, issuer := range issuers {
+		if strings.Contains(issuer, "*") {
+			continue
+		}
+		parsed, err := url.Parse(issuer)
+		if err != nil {
+			return fmt.Errorf("invalid issuer %s: %v", issuer, err)
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("invalid issuer %s: must be an absolute URL such as https://%s", issuer, strings.TrimPrefix(issuer, "//"))
+		}
+		if requireTLS && isPlaintextURL(issuer) {
+			return fmt.Errorf("invalid issuer %s: keys must not be fetched over plaintext http unless requireTLSIssuers is false", issuer)
+		}
+		if endpoint, ok := endpoints[issuer]; ok && requireTLS && isPlaintextURL(endpoint) {
+			return fmt.Errorf("invalid jwks %s: keys must not be fetched over plaintext http unless requireTLSIssuers is false", endpoint)
+		}
+		for _, endpoint := range additional[issuer] {
+			if requireTLS && isPlaintextURL(endpoint) {
+				return fmt.Errorf("invalid additionalJWKSURLs %s: keys must not be fetched over plaintext http unless requireTLSIssuers is false", endpoint)
+			}
+		}
+	}
+	return nil
+}
+
+// isPlaintextURL returns true if the URL is plain http to anything other than a loopback address, where there is nothing to intercept.
+func isPlaintextURL(address string) bool {
+	parsed, err := url.Parse(address)
+	if err != nil || !strings.EqualFold(parsed.Scheme, "http") {
+		return false
+	}
+	host := parsed.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// splitIssuerTemplates separates issuers that contain Go templates, which are evaluated per-request, from the static issuers.
+func splitIssuerTemplates(issuers []string) (static []string, templates []*template.Template, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			static, templates, err = nil, nil, fmt.Errorf("invalid issuer template: %v", recovered)
+		}
+	}()
+	static = make([]string, 0, len(issuers))
+	for _, issuer := range issuers {
+		if strings.Contains(issuer, "{{") {
+			templates = append(templates, NewTemplate(issuer))
+		} else {
+			static = append(static, issuer)
 		}
 	}
-	return issuers, endpoints, nil
+	return static, templates, nil
 }
 
 // canonicalizeDomain adds a trailing slash to the domain
@@ -585,6 +2676,30 @@ func canonicalizeDomains(domains []string) []string {
 	return domains
 }
 
+// checkRSABits returns an error if key is an RSA key smaller than minBits, which is disabled if 0.
+func checkRSABits(key any, minBits int) error {
+	if public, ok := key.(*rsa.PublicKey); ok && minBits > 0 && public.N.BitLen() < minBits {
+		return fmt.Errorf("RSA key is %d bits; minRSABits is %d", public.N.BitLen(), minBits)
+	}
+	return nil
+}
+
+// setupInlineJWKS parses the inlineJWKS configuration, which is either a JWKS document or a path to a file containing one.
+func setupInlineJWKS(raw string) (map[string]any, error) {
+	if raw == "" {
+		return make(map[string]any), nil
+	}
+	content := []byte(raw)
+	if !strings.HasPrefix(strings.TrimSpace(raw), "{") {
+		var err error
+		content, err = os.ReadFile(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ParseJWKS(content)
+}
+
 // pemContent returns the value if it is alread a PEM or reads the file if it is a filename.
 func pemContent(value string) (string, error) {
 	if value == "" || strings.HasPrefix(value, "-----BEGIN") {
@@ -598,11 +2713,15 @@ func pemContent(value string) (string, error) {
 }
 
 // NewDefaultClient returns an http.Client with the given root CAs, or a default client if no root CAs are provided.
+// The root CAs are added to the system pool, so that issuers with publicly trusted certificates are still trusted too.
 func NewDefaultClient(pems []string, useSystemCertPool bool) *http.Client {
 	if pems == nil {
 		return &http.Client{}
 	}
-	certs, _ := x509.SystemCertPool()
+	certs, err := x509.SystemCertPool()
+	if err != nil && useSystemCertPool {
+		log.Printf("failed to load the system certificate pool; trusting only rootCAs: %v", err)
+	}
 	if certs == nil || !useSystemCertPool {
 		// We don't plan an option to set useSystemCertPool=false but it helps with test coverage
 		certs = x509.NewCertPool()
@@ -620,6 +2739,17 @@ func NewDefaultClient(pems []string, useSystemCertPool bool) *http.Client {
 	return &http.Client{Transport: transport}
 }
 
+// setClientTimeouts sets the timeout of the requests made by all the clients, if a timeout is given.
+func setClientTimeouts(clients map[string]*http.Client, defaultClient *http.Client, timeout time.Duration) {
+	if timeout == 0 {
+		return
+	}
+	defaultClient.Timeout = timeout
+	for _, client := range clients {
+		client.Timeout = timeout // the clients may be shared, so this may set the same one more than once
+	}
+}
+
 // NewClients reads a list of domains in the InsecureSkipVerify configuration and creates a map of domains to http.Client with InsecureSkipVerify set.
 func NewClients(insecureSkipVerify []string) map[string]*http.Client {
 	// Create a single client with InsecureSkipVerify set
@@ -631,11 +2761,44 @@ func NewClients(insecureSkipVerify []string) map[string]*http.Client {
 	// Use it for all issuers in the InsecureSkipVerify configuration
 	clients := make(map[string]*http.Client, len(insecureSkipVerify))
 	for _, issuer := range insecureSkipVerify {
+		if isSkipVerifyAll(issuer) {
+			issuer = wildcardHost
+		} else if strings.Contains(issuer, "://") {
+			// A full issuer URL applies to its host and port only, so as not to affect other issuers on the same host
+			parsed, err := url.Parse(issuer)
+			if err != nil {
+				log.Printf("failed to parse insecureSkipVerify url %s: %v", issuer, err)
+				continue
+			}
+			issuer = hostPort(parsed)
+		}
 		clients[issuer] = client
 	}
 	return clients
 }
 
+// hostPort returns the host:port of the URL, with the scheme's default port if the URL has none,
+// so that https://issuer.example.com and issuer.example.com:443 are the same key in the clients map.
+func hostPort(parsed *url.URL) string {
+	port := parsed.Port()
+	if port == "" {
+		switch strings.ToLower(parsed.Scheme) {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		default:
+			return parsed.Host
+		}
+	}
+	return net.JoinHostPort(parsed.Hostname(), port)
+}
+
+// isSkipVerifyAll returns true if the insecureSkipVerify entry means all hosts: "*" or true (which decodes as "true" or "1").
+func isSkipVerifyAll(entry string) bool {
+	return entry == wildcardHost || entry == "1" || strings.EqualFold(entry, "true")
+}
+
 // NewTemplate creates a template from the given string, or nil if not specified.
 func NewTemplate(text string) *template.Template {
 	if text == "" {
@@ -654,15 +2817,30 @@ func NewTemplate(text string) *template.Template {
 // We start with a clone of our environment variables and add the the per-request variables.
 // The purpose of environment variables is to allow a easier way to set a configurable but then fixed value for a claim
 // requirement in the configuration file (as rewriting the configuration file is harder than setting environment variables).
+// If no templates are configured, the environment variables and the variables only templates use (Nonce and State) are
+// skipped, as copying the environment for every request is wasted effort for the common API case.
 func (plugin *JWTPlugin) NewTemplateVariables(request *http.Request) *TemplateVariables {
-	// copy the environment variables
-	variables := make(TemplateVariables, len(plugin.environment)+6)
-	for key, value := range plugin.environment {
-		variables[key] = value
+	templates := plugin.usesTemplates()
+	var variables TemplateVariables
+	if templates {
+		// copy the environment variables
+		variables = make(TemplateVariables, len(plugin.environment)+8)
+		for key, value := range plugin.environment {
+			variables[key] = value
+		}
+	} else {
+		variables = make(TemplateVariables, 8)
 	}
 
 	variables["Method"] = request.Method
 	variables["Host"] = request.Host
+	variables["Language"] = primaryLanguage(request.Header.Get("Accept-Language"))
+	if templates {
+		variables["Nonce"] = newNonce()
+		if len(plugin.stateSecret) != 0 && variables["Nonce"] != "" {
+			variables["State"] = signState(variables["Nonce"], time.Now(), plugin.stateSecret)
+		}
+	}
 	variables["Path"] = request.URL.RequestURI()
 	if request.URL.Host != "" {
 		// If request.URL.Host is set, we can use all the URL values directly
@@ -670,20 +2848,210 @@ func (plugin *JWTPlugin) NewTemplateVariables(request *http.Request) *TemplateVa
 		variables["URL"] = request.URL.String()
 	} else {
 		// (In at least some situations) Traefik sets only the path in the request.URL, so we need to reconstruct it
+		if request.URL.RawQuery == "" {
+			variables["Path"] = forwardedRequestURI(request)
+		}
 		variables["Scheme"] = request.Header.Get("X-Forwarded-Proto")
 		if variables["Scheme"] == "" {
 			variables["Scheme"] = "https"
 		}
 		variables["URL"] = fmt.Sprintf("%s://%s%s", variables["Scheme"], variables["Host"], variables["Path"])
 	}
+	plugin.setRequestAttributes(request, &variables)
 
 	if plugin.logUnauthorized != "" {
 		variables["logUnauthorized"] = plugin.logUnauthorized
 	}
 
+	if plugin.coerceBooleans {
+		variables["coerceBooleans"] = "true"
+	}
+
+	if plugin.reportAllFailures {
+		variables["reportAllFailures"] = "true"
+	}
+
+	if plugin.requestIDHeader != "" {
+		variables["RequestID"] = request.Header.Get(plugin.requestIDHeader)
+	}
+
 	return &variables
 }
 
+// setRequestAttributes sets the attributes of the request for $request. requirements in the variables. Unlike the Path
+// and URL template variables, the path is decoded, so that a percent-encoded path can't evade a glob, and doesn't include
+// the query. In forwardAuthMode, the method, scheme, host, path and query are those of the original request.
+func (plugin *JWTPlugin) setRequestAttributes(request *http.Request, variables *TemplateVariables) {
+	method, path := plugin.requestTarget(request)
+	scheme, host := (*variables)["Scheme"], (*variables)["Host"]
+	_, query, _ := strings.Cut((*variables)["Path"], "?")
+	if plugin.forwardAuthMode {
+		if forwarded := request.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+		if forwarded := request.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+			scheme = forwarded
+		}
+		_, query, _ = strings.Cut(request.Header.Get("X-Forwarded-Uri"), "?")
+	}
+	(*variables)[requestPrefix+"method"] = method
+	(*variables)[requestPrefix+"host"] = host
+	(*variables)[requestPrefix+"path"] = path
+	(*variables)[requestPrefix+"scheme"] = scheme
+	(*variables)[requestPrefix+"url"] = fmt.Sprintf("%s://%s%s", scheme, host, path)
+	if query != "" {
+		(*variables)[requestPrefix+"url"] += "?" + query
+	}
+}
+
+// forwardedRequestURI returns the request URI including the query from X-Forwarded-Uri, for configurations where the
+// query is present only there. To prevent spoofing of the path, it is only used if it is for the same path as the request.
+func forwardedRequestURI(request *http.Request) string {
+	forwarded, err := url.ParseRequestURI(request.Header.Get("X-Forwarded-Uri"))
+	if err != nil || forwarded.RawQuery == "" || forwarded.Path != request.URL.Path {
+		return request.URL.RequestURI()
+	}
+	return forwarded.RequestURI()
+}
+
+// ensureRequestID sets a newly generated correlation id in the requestIDHeader, if configured, unless one is already present.
+// As the header remains in the request, it is also forwarded to the backend.
+func (plugin *JWTPlugin) ensureRequestID(request *http.Request) {
+	if plugin.requestIDHeader == "" || request.Header.Get(plugin.requestIDHeader) != "" {
+		return
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Printf("failed to generate request id: %v", err)
+		return
+	}
+	request.Header.Set(plugin.requestIDHeader, hex.EncodeToString(id))
+}
+
+// newNonce returns a hex encoded cryptographically random value for use once, e.g. as the state or nonce of a login redirect,
+// or empty if one can't be generated.
+func newNonce() string {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		log.Printf("failed to generate nonce: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// signState returns nonce.issued.signature, where issued is the Unix issue time and signature is the hex encoded HMAC-SHA256
+// of nonce.issued keyed with secret, so that verifyState can check that a returned state was issued by the middleware, and when.
+func signState(nonce string, issued time.Time, secret []byte) string {
+	payload := nonce + "." + strconv.FormatInt(issued.Unix(), 10)
+	return payload + "." + stateSignature(payload, secret)
+}
+
+// stateSignature returns the hex HMAC-SHA256 of the state payload with the secret.
+func stateSignature(payload string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyState checks a state returned on the request's query against its signature, its issue time and the state cookie,
+// so that a state is only accepted from the browser it was issued to, and only for stateMaxAge.
+// Requests without a state or the state cookie, or when no stateSecret is configured, are not checked, as the backend may
+// use a state parameter of its own, e.g. for its own OAuth callback, which no redirect of ours led to.
+func (plugin *JWTPlugin) verifyState(request *http.Request) error {
+	if len(plugin.stateSecret) == 0 {
+		return nil
+	}
+	cookie, err := request.Cookie(plugin.stateCookie.Name)
+	if err != nil {
+		return nil
+	}
+	query := request.URL.Query()
+	if plugin.forwardAuthMode {
+		forwarded, err := url.ParseRequestURI(request.Header.Get("X-Forwarded-Uri"))
+		if err != nil {
+			return nil
+		}
+		query = forwarded.Query()
+	}
+	state := query.Get("state")
+	if state == "" {
+		return nil
+	}
+
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid state: malformed")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(stateSignature(payload, plugin.stateSecret))) {
+		return fmt.Errorf("invalid state: bad signature")
+	}
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid state: malformed issue time")
+	}
+	if age := time.Since(time.Unix(issued, 0)); age > plugin.stateMaxAge || age < -time.Minute {
+		return fmt.Errorf("invalid state: expired")
+	}
+	if !hmac.Equal([]byte(cookie.Value), []byte(parts[0])) {
+		return fmt.Errorf("invalid state: not issued to this client")
+	}
+	return nil
+}
+
+// requestLog logs at the given level as logger.Log, prefixing the message with the request's correlation id if there is one.
+func requestLog(variables *TemplateVariables, level string, format string, fields ...any) {
+	if id := (*variables)["RequestID"]; id != "" {
+		format = "request:%s " + format
+		fields = append([]any{id}, fields...)
+	}
+	logger.Log(level, format, fields...)
+}
+
+// primaryLanguage returns the primary language subtag, lowercased, of the most preferred language in an Accept-Language
+// header, e.g. "fr" for "fr-CH, fr;q=0.9, en;q=0.8", or "" if there is none. An entry whose primary subtag isn't 1 to 8
+// ASCII letters is ignored, as the result may be used in a redirect URL or header.
+func primaryLanguage(header string) string {
+	language := ""
+	best := 0.0
+	for _, entry := range strings.Split(header, ",") {
+		tag, parameters, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(parameters), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		primary, _, _ := strings.Cut(tag, "-")
+		if quality > best && isLanguageSubtag(primary) {
+			language, best = strings.ToLower(primary), quality
+		}
+	}
+	return language
+}
+
+// isLanguageSubtag returns whether subtag is a well-formed primary language subtag: 1 to 8 ASCII letters.
+func isLanguageSubtag(subtag string) bool {
+	if len(subtag) == 0 || len(subtag) > 8 {
+		return false
+	}
+	for index := 0; index < len(subtag); index++ {
+		character := subtag[index] | 0x20 // lowercase
+		if character < 'a' || character > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
 // NewStringSet returns a set of strings
 func NewCaseInsensitiveSet(values []string) map[string]struct{} {
 	set := make(map[string]struct{}, len(values))
@@ -706,19 +3074,61 @@ func expandTemplate(redirectTemplate *template.Template, variables *TemplateVari
 
 }
 
-// extractToken extracts the token from the request using the first configured method that finds one, in order of cookie, header, query parameter.
-func (plugin *JWTPlugin) extractToken(request *http.Request) string {
-	token := ""
+// extractTokens extracts the token from the request using the first configured method that finds one, in order of cookie, header, query parameter.
+// There is only ever one token, except from a header with multiple values when multipleHeaderValues is any, in which case
+// there is one for each value. An error is returned for such a header when multipleHeaderValues is reject.
+func (plugin *JWTPlugin) extractTokens(request *http.Request) ([]string, error) {
+	if plugin.renameTokenHeader != "" {
+		// The backend must only ever see the token we moved there, never one supplied by the client
+		request.Header.Del(plugin.renameTokenHeader)
+	}
+	var tokens []string
+	var err error
 	if plugin.cookieName != "" {
-		token = plugin.extractTokenFromCookie(request)
+		tokens = nonEmpty(plugin.extractTokenFromCookie(request))
 	}
-	if len(token) == 0 && plugin.headerName != "" {
-		token = plugin.extractTokenFromHeader(request)
+	if len(tokens) == 0 && plugin.headerName != "" {
+		tokens, err = plugin.extractTokensFromHeader(request)
 	}
-	if len(token) == 0 && plugin.parameterName != "" {
-		token = plugin.extractTokenFromQuery(request)
+	if len(tokens) == 0 && err == nil && len(plugin.parameterNames) > 0 {
+		tokens = nonEmpty(plugin.extractTokenFromQuery(request))
+	}
+	if len(tokens) == 0 && err == nil && plugin.websocketProtocolToken {
+		tokens = nonEmpty(plugin.extractTokenFromWebsocketProtocol(request))
+	}
+	if plugin.stripAllTokenSources && !plugin.forwardToken {
+		plugin.stripTokenSources(request)
+	}
+	return tokens, err
+}
+
+// nonEmpty returns a list of the token, or an empty list if it is "".
+func nonEmpty(token string) []string {
+	if token == "" {
+		return nil
+	}
+	return []string{token}
+}
+
+// stripTokenSources removes all of the configured token sources from the request, so that no secondary copy of a token,
+// such as one in the query as well as the header, is passed on to the backend.
+func (plugin *JWTPlugin) stripTokenSources(request *http.Request) {
+	if plugin.cookieName != "" {
+		removeCookie(request, plugin.cookieName)
+	}
+	if plugin.headerName != "" {
+		if header, ok := request.Header[plugin.headerName]; ok && !plugin.isIgnoredScheme(header[0]) {
+			request.Header.Del(plugin.headerName)
+		}
+	}
+	for _, name := range plugin.parameterNames {
+		if request.URL.Query().Has(name) {
+			removeQueryParameter(request, name)
+		}
+	}
+	if token, _, others := plugin.websocketProtocols(request); token != "" {
+		setWebsocketProtocols(request, others)
 	}
-	return token
 }
 
 // extractTokenFromCookie extracts the token from the cookie. If the token is found, it is removed from the cookies unless forwardToken is true.
@@ -728,51 +3138,248 @@ func (plugin *JWTPlugin) extractTokenFromCookie(request *http.Request) string {
 		return ""
 	}
 	if !plugin.forwardToken {
-		cookies := request.Cookies()
-		request.Header.Del("Cookie")
-		for _, cookie := range cookies {
-			if cookie.Name != plugin.cookieName {
-				request.AddCookie(cookie)
-			}
-		}
+		removeCookie(request, plugin.cookieName)
 	}
 	return cookie.Value
 }
 
-// extractTokenFromHeader extracts the token from the header. If the token is found, it is removed from the header unless forwardToken is true.
-func (plugin *JWTPlugin) extractTokenFromHeader(request *http.Request) string {
+// hasCookie returns true if the request has the named cookie.
+func hasCookie(request *http.Request, name string) bool {
+	_, err := request.Cookie(name)
+	return err == nil
+}
+
+// newClearCookie returns the cookie that clears the token cookie, with the configured attributes, if clearCookieOnUnauthorized is set.
+func newClearCookie(config *Config) (*http.Cookie, error) {
+	if !config.ClearCookieOnUnauthorized {
+		return nil, nil
+	}
+	if config.CookieName == "" {
+		return nil, fmt.Errorf("clearCookieOnUnauthorized requires cookieName")
+	}
+	cookie := &http.Cookie{
+		Name:     config.CookieName,
+		Value:    "",
+		Path:     config.CookiePath,
+		Domain:   config.CookieDomain,
+		MaxAge:   -1,
+		Secure:   config.CookieSecure,
+		HttpOnly: config.CookieHTTPOnly,
+	}
+	switch strings.ToLower(config.CookieSameSite) {
+	case "":
+	case "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid cookieSameSite %q: expected lax, strict or none", config.CookieSameSite)
+	}
+	return cookie, nil
+}
+
+// newStateCookie returns the prototype of the cookie that binds a state to the browser, or nil if no stateSecret is configured.
+// It must be sent on the top-level redirect back from the identity provider, so it is always SameSite=Lax.
+func newStateCookie(config *Config, maxAge time.Duration) *http.Cookie {
+	if config.StateSecret == "" {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     stateCookieName,
+		Path:     config.CookiePath,
+		Domain:   config.CookieDomain,
+		MaxAge:   int(maxAge / time.Second),
+		Secure:   config.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// removeCookie removes the named cookie from the request, leaving any others.
+func removeCookie(request *http.Request, name string) {
+	cookies := request.Cookies()
+	request.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			request.AddCookie(cookie)
+		}
+	}
+}
+
+// extractTokensFromHeader extracts the token from the header. If the token is found, it is removed from the header unless forwardToken is true,
+// or moved, as it was, to renameTokenHeader if that is set. If the header has multiple values, only the first is used,
+// unless multipleHeaderValues is any, when all are, or reject, when an error is returned.
+func (plugin *JWTPlugin) extractTokensFromHeader(request *http.Request) ([]string, error) {
 	header, ok := request.Header[plugin.headerName]
 	if !ok {
-		return ""
+		return nil, nil
+	}
+	if len(header) > 1 {
+		switch plugin.multipleHeaderValues {
+		case multipleValuesReject:
+			// Which token is meant is ambiguous, and a proxy may have chosen differently, so this is likely an attack
+			request.Header.Del(plugin.headerName)
+			return nil, errMultipleTokens
+		case multipleValuesFirst:
+			header = header[:1]
+		}
 	}
 
-	token := header[0]
+	tokens := make([]string, 0, len(header))
+	for _, token := range header {
+		// Credentials for another scheme are not a malformed token but no token at all, and are left for the backend
+		if plugin.isIgnoredScheme(token) {
+			continue
+		}
+		if len(token) >= 7 && strings.EqualFold(token[:7], "Bearer ") {
+			token = token[7:]
+		}
+		tokens = append(tokens, token)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
 
 	if !plugin.forwardToken {
+		if plugin.renameTokenHeader != "" {
+			for _, token := range header {
+				request.Header.Add(plugin.renameTokenHeader, token)
+			}
+		}
 		request.Header.Del(plugin.headerName)
 	}
+	return tokens, nil
+}
+
+// newIgnoredSchemes returns the configured ignored schemes, lowercased, or the default set of non-Bearer schemes.
+// Like scopeClaims, it is defaulted here rather than in CreateConfig.
+func newIgnoredSchemes(configured []string) []string {
+	if len(configured) == 0 {
+		return []string{"basic", "negotiate"}
+	}
+	schemes := make([]string, len(configured))
+	for index, scheme := range configured {
+		schemes[index] = strings.ToLower(scheme)
+	}
+	return schemes
+}
+
+// isIgnoredScheme returns true if the header value is credentials for one of the ignoredSchemes.
+func (plugin *JWTPlugin) isIgnoredScheme(value string) bool {
+	scheme, _, found := strings.Cut(value, " ")
+	if !found {
+		return false
+	}
+	scheme = strings.ToLower(scheme)
+	for _, ignored := range plugin.ignoredSchemes {
+		if scheme == ignored {
+			return true
+		}
+	}
+	return false
+}
 
-	if len(token) >= 7 && strings.EqualFold(token[:7], "Bearer ") {
-		return token[7:]
+// extractTokenFromWebsocketProtocol extracts the token from the Sec-WebSocket-Protocol header of a WebSocket upgrade,
+// as browser clients can't set the Authorization header. If the token is found, its sub-protocol is removed from the header
+// unless forwardToken is true.
+func (plugin *JWTPlugin) extractTokenFromWebsocketProtocol(request *http.Request) string {
+	token, _, others := plugin.websocketProtocols(request)
+	if token != "" && !plugin.forwardToken {
+		setWebsocketProtocols(request, others)
 	}
 	return token
 }
 
+// acceptedWebsocketProtocol returns the sub-protocol to accept in the response to a WebSocket upgrade, if the client's
+// only sub-protocol is the token's and it is removed, as the backend then sees none to accept and the handshake would fail.
+// Only a prefixed token's sub-protocol is accepted, as the raw token mustn't be echoed in the response. If the client
+// requests other sub-protocols, the backend accepts one of them itself.
+func (plugin *JWTPlugin) acceptedWebsocketProtocol(request *http.Request) string {
+	token, protocol, others := plugin.websocketProtocols(request)
+	if token == "" || len(others) != 0 || plugin.forwardToken || plugin.websocketProtocolPrefix == "" {
+		return ""
+	}
+	return protocol
+}
+
+// websocketProtocols returns any token in the sub-protocols requested by a WebSocket upgrade, the token's sub-protocol,
+// and the other sub-protocols.
+func (plugin *JWTPlugin) websocketProtocols(request *http.Request) (token string, tokenProtocol string, others []string) {
+	if !plugin.websocketProtocolToken || !strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		return "", "", nil
+	}
+	for _, header := range request.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if protocol == "" {
+				continue
+			}
+			if token == "" && plugin.isTokenProtocol(protocol) {
+				token = strings.TrimPrefix(protocol, plugin.websocketProtocolPrefix)
+				tokenProtocol = protocol
+			} else {
+				others = append(others, protocol)
+			}
+		}
+	}
+	return token, tokenProtocol, others
+}
+
+// isTokenProtocol returns true if the sub-protocol carries the token: it has the websocketProtocolPrefix or, if there is none, looks like a JWT.
+func (plugin *JWTPlugin) isTokenProtocol(protocol string) bool {
+	if plugin.websocketProtocolPrefix != "" {
+		return len(protocol) > len(plugin.websocketProtocolPrefix) && strings.HasPrefix(protocol, plugin.websocketProtocolPrefix)
+	}
+	return strings.Count(protocol, ".") == 2
+}
+
+// setWebsocketProtocols replaces the Sec-WebSocket-Protocol header of the request with the given sub-protocols.
+func setWebsocketProtocols(request *http.Request, protocols []string) {
+	if len(protocols) == 0 {
+		request.Header.Del("Sec-WebSocket-Protocol")
+		return
+	}
+	request.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+}
+
 // extractTokenFromQuery extracts the token from the query parameter. If the token is found, it is removed from the query unless forwardToken is true.
+// The parameterNames are tried in order, and only the parameter that yielded the token is removed.
 func (plugin *JWTPlugin) extractTokenFromQuery(request *http.Request) string {
-	if request.URL.Query().Has(plugin.parameterName) {
-		token := request.URL.Query().Get(plugin.parameterName)
+	query := request.URL.Query()
+	for _, name := range plugin.parameterNames {
+		token := query.Get(name)
+		if token == "" {
+			continue
+		}
 		if !plugin.forwardToken {
-			query := request.URL.Query()
-			query.Del(plugin.parameterName)
-			request.URL.RawQuery = query.Encode()
-			request.RequestURI = request.URL.RequestURI()
+			removeQueryParameter(request, name)
 		}
 		return token
 	}
 	return ""
 }
 
+// newParameterNames returns the parameterName, if any, followed by any further parameterNames, such as legacy names.
+func newParameterNames(name string, names []string) []string {
+	result := make([]string, 0, len(names)+1)
+	for _, name := range append([]string{name}, names...) {
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// removeQueryParameter removes the named parameter from the request's query.
+func removeQueryParameter(request *http.Request, name string) {
+	query := request.URL.Query()
+	query.Del(name)
+	request.URL.RawQuery = query.Encode()
+	request.RequestURI = request.URL.RequestURI()
+}
+
 // The following code is copied from the Go standard library net/http package, as hasToken is not exported.
 // We have also added '+' as a token boundary character.
 
@@ -0,0 +1,109 @@
+package jwt_middleware
+
+import (
+	"fmt"
+
+	"github.com/agilezebra/jwt-middleware/logger"
+)
+
+// KeySource is a source of the keys for trusted issuers. The default fetches them over HTTP from each issuer's JWKS endpoint,
+// but a different source, such as Vault or a KMS, may be set with SetKeySource when embedding the plugin as a library.
+type KeySource interface {
+	// KeysForIssuer returns the issuer's current keys as a map kid -> key. The issuer has a trailing slash.
+	KeysForIssuer(issuer string) (map[string]any, error)
+}
+
+// SetKeySource sets the source of the keys for issuers, or restores the default HTTP source if source is nil.
+// It should be set before the plugin serves any requests, and with skipPrefetch set so that keys aren't prefetched from the default source.
+func (plugin *JWTPlugin) SetKeySource(source KeySource) {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	if source == nil {
+		source = httpKeySource{plugin: plugin}
+	}
+	plugin.keySource = source
+}
+
+// KeySource returns the source of the keys for issuers.
+func (plugin *JWTPlugin) KeySource() KeySource {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	return plugin.keySource
+}
+
+// httpKeySource is the default KeySource, which fetches keys from each issuer's JWKS endpoint (or hard-coded endpoint),
+// discovered from its OpenID configuration, together with any additional endpoints configured for the issuer.
+type httpKeySource struct {
+	plugin *JWTPlugin
+}
+
+// KeysForIssuer fetches the keys from the well-known or custom jwks endpoint for the given issuer.
+func (source httpKeySource) KeysForIssuer(issuer string) (map[string]any, error) {
+	plugin := source.plugin
+	url, ok := plugin.issuerJWKSEndpoints[issuer]
+	configURL := issuer + plugin.openidConfigPath // issuer has trailing slash
+	discovered := false
+	if !ok {
+		if plugin.requireTLSIssuers && isPlaintextURL(configURL) {
+			return nil, fmt.Errorf("refusing to fetch keys over plaintext http from %s", configURL)
+		}
+		config, err := plugin.fetchOpenIDConfiguration(configURL)
+
+		if err != nil {
+			// Fall back to direct JWKS URL if OpenID configuration fetch fails
+			url = issuer + plugin.jwksPath
+			logger.Log("WARN", "failed to fetch openid-configuration from url:%s; falling back to direct JWKS URL:%s", configURL, url)
+		} else {
+			url = config.JWKSURI
+			discovered = true
+		}
+	}
+
+	if plugin.requireTLSIssuers && isPlaintextURL(url) {
+		// Such as a jwks_uri discovered from the issuer, or the endpoints of a templated issuer
+		return nil, fmt.Errorf("refusing to fetch keys over plaintext http from %s", url)
+	}
+
+	jwks, err := source.fetch(issuer, url)
+	if err != nil {
+		if discovered && plugin.discoveryCache != nil {
+			// The jwks_uri may have changed, so discover it afresh next time
+			plugin.discoveryCache.remove(configURL)
+		}
+		return nil, err
+	}
+
+	// The issuer's keys are all of those from its additional endpoints too. If any fetch fails, so does the whole fetch,
+	// so that the keys from that endpoint aren't purged as if the issuer no longer had them.
+	for _, additional := range plugin.issuerAdditionalJWKS[issuer] {
+		keys, err := source.fetch(issuer, additional)
+		if err != nil {
+			return nil, err
+		}
+		for keyID, key := range keys {
+			if _, ok := jwks[keyID]; ok {
+				logger.Log("WARN", "ignoring kid:%s from url:%s as it is already provided by issuer:%s", keyID, additional, issuer)
+				continue
+			}
+			jwks[keyID] = key
+		}
+	}
+	return jwks, nil
+}
+
+// fetch fetches the keys from the given endpoint of the issuer in the issuer's configured format.
+func (source httpKeySource) fetch(issuer string, url string) (map[string]any, error) {
+	plugin := source.plugin
+	var jwks map[string]any
+	var err error
+	if plugin.issuerKeyFormats[issuer] == keysFormatPEM {
+		jwks, err = FetchPEMKeysWithOptions(url, plugin.clientForURL(url), plugin.fetchOptions())
+	} else {
+		jwks, err = FetchJWKSWithOptions(url, plugin.clientForURL(url), plugin.fetchOptions())
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Log("INFO", "fetched %d keys from url:%s", len(jwks), url)
+	return jwks, nil
+}
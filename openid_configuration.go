@@ -3,16 +3,31 @@ package jwt_middleware
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type OpenIDConfiguration struct {
 	JWKSURI string `json:"jwks_uri"`
 }
 
+// FetchOptions are the options for fetching OpenID configurations and keys.
+type FetchOptions struct {
+	UserAgent     string // The User-Agent to send, or empty for Go's default
+	MaxBytes      int64  // The maximum length of the response, or 0 for the default of 1MiB
+	RejectPrivate bool   // If set, a JWKS with any keys that include private parameters fails the fetch, rather than those keys being ignored
+}
+
 // FetchOpenIDConfiguration fetches the OpenID configuration from the given URL.
 func FetchOpenIDConfiguration(url string, client *http.Client) (*OpenIDConfiguration, error) {
-	response, err := client.Get(url)
+	return FetchOpenIDConfigurationWithOptions(url, client, FetchOptions{})
+}
+
+// FetchOpenIDConfigurationWithOptions fetches the OpenID configuration from the given URL with the given options.
+func FetchOpenIDConfigurationWithOptions(url string, client *http.Client, options FetchOptions) (*OpenIDConfiguration, error) {
+	response, err := fetch(url, client, options.UserAgent)
 	if err != nil {
 		return nil, err
 	}
@@ -22,10 +37,120 @@ func FetchOpenIDConfiguration(url string, client *http.Client) (*OpenIDConfigura
 		return nil, fmt.Errorf("got %d from %s", response.StatusCode, url)
 	}
 	var config OpenIDConfiguration
-	err = json.NewDecoder(response.Body).Decode(&config)
+	err = decodeLimited(response, url, options.maxBytes(), &config)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", url, err)
+		return nil, err
 	}
 
 	return &config, nil
 }
+
+// fetch GETs the given URL with the client, setting the User-Agent if one is given.
+func fetch(url string, client *http.Client, userAgent string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	return client.Do(request)
+}
+
+// defaultMaxJWKSBytes is the maximum size of a JWKS or discovery response unless maxJWKSBytes is set: far larger than
+// any genuine key set, but small enough that a malicious or misconfigured endpoint can't exhaust memory.
+const defaultMaxJWKSBytes = 1 << 20
+
+// newMaxJWKSBytes returns the configured maxJWKSBytes, or the default if it isn't set.
+func newMaxJWKSBytes(maxBytes int) int64 {
+	if maxBytes <= 0 {
+		return defaultMaxJWKSBytes
+	}
+	return int64(maxBytes)
+}
+
+// maxBytes returns the MaxBytes option, or the default if it isn't set.
+func (options FetchOptions) maxBytes() int64 {
+	if options.MaxBytes <= 0 {
+		return defaultMaxJWKSBytes
+	}
+	return options.MaxBytes
+}
+
+// decodeLimited decodes the JSON body of the response from url into value, failing without reading any further if the
+// body is more than maxBytes long.
+func decodeLimited(response *http.Response, url string, maxBytes int64, value any) error {
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBytes+1))
+	if err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	if int64(len(body)) > maxBytes {
+		return fmt.Errorf("%s: response exceeds %d bytes", url, maxBytes)
+	}
+	err = json.Unmarshal(body, value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return nil
+}
+
+// discoveryCacheEntry is a cached OpenID configuration.
+type discoveryCacheEntry struct {
+	config  *OpenIDConfiguration
+	expires time.Time
+}
+
+// discoveryCache is a bounded cache of OpenID configurations keyed by URL, shared across all issuers.
+type discoveryCache struct {
+	lock       sync.Mutex
+	entries    map[string]discoveryCacheEntry
+	duration   time.Duration
+	maxEntries int // The maximum number of entries, beyond which the entry closest to expiry is evicted
+}
+
+// newDiscoveryCache creates a cache holding configurations for the given duration, or nil if the duration is 0.
+func newDiscoveryCache(duration time.Duration) *discoveryCache {
+	if duration == 0 {
+		return nil
+	}
+	return &discoveryCache{entries: make(map[string]discoveryCacheEntry), duration: duration, maxEntries: 256}
+}
+
+// get returns the cached configuration for url, or nil if there is no unexpired entry.
+func (cache *discoveryCache) get(url string) *OpenIDConfiguration {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[url]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.config
+}
+
+// set caches the configuration for url, evicting expired entries, or the entry closest to expiry, if the cache is full.
+func (cache *discoveryCache) set(url string, config *OpenIDConfiguration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	if _, ok := cache.entries[url]; !ok && len(cache.entries) >= cache.maxEntries {
+		oldest := ""
+		for key, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			} else if oldest == "" || entry.expires.Before(cache.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		if len(cache.entries) >= cache.maxEntries {
+			delete(cache.entries, oldest)
+		}
+	}
+	cache.entries[url] = discoveryCacheEntry{config: config, expires: now.Add(cache.duration)}
+}
+
+// remove removes any cached configuration for url.
+func (cache *discoveryCache) remove(url string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.entries, url)
+}
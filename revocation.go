@@ -0,0 +1,118 @@
+package jwt_middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/agilezebra/jwt-middleware/logger"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// errTokenRevoked is returned for a token whose sub or jti is in the revocation list.
+var errTokenRevoked = errors.New("token has been revoked")
+
+// errRevocationsUnavailable is returned for every token while the revocation list can't be fetched, unless revocationFailOpen is set.
+var errRevocationsUnavailable = errors.New("revocation list is unavailable")
+
+// RevocationList is the document served at the revocationURL, listing the tokens that must no longer be accepted
+// by their subject (e.g. a compromised account) or their ID.
+type RevocationList struct {
+	Subjects []string `json:"sub"`
+	IDs      []string `json:"jti"`
+}
+
+// FetchRevocationList fetches the revocation list from the given URL.
+func FetchRevocationList(url string, client *http.Client, userAgent string) (*RevocationList, error) {
+	response, err := fetch(url, client, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", response.StatusCode, url)
+	}
+	var list RevocationList
+	err = json.NewDecoder(response.Body).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+
+	return &list, nil
+}
+
+// revocations holds the revoked subjects and token IDs from the latest revocation list.
+type revocations struct {
+	lock     sync.RWMutex
+	subjects map[string]struct{}
+	ids      map[string]struct{}
+	failed   bool // If the latest fetch failed, or none has yet been made
+}
+
+// newRevocations returns the revocations for the revocationURL, or nil if none is configured.
+// Until the list is first fetched, it is treated as unavailable.
+func newRevocations(url string) *revocations {
+	if url == "" {
+		return nil
+	}
+	return &revocations{failed: true}
+}
+
+// fetchRevocations fetches the revocation list, if configured, replacing the current one. If the fetch fails, the current
+// list is kept for revocationFailOpen, but is otherwise unavailable until a fetch succeeds.
+func (plugin *JWTPlugin) fetchRevocations() {
+	if plugin.revocations == nil {
+		return
+	}
+	list, err := FetchRevocationList(plugin.revocationURL, plugin.clientForURL(plugin.revocationURL), plugin.userAgent)
+	plugin.revocations.lock.Lock()
+	defer plugin.revocations.lock.Unlock()
+	if err != nil {
+		log.Printf("failed to fetch revocation list from %s: %v", plugin.revocationURL, err)
+		plugin.revocations.failed = true
+		plugin.invalidateDecisions() // so that, unless failing open, tokens are rejected until the list is available again
+		return
+	}
+	plugin.revocations.subjects = newStringSet(list.Subjects)
+	plugin.revocations.ids = newStringSet(list.IDs)
+	plugin.revocations.failed = false
+	plugin.invalidateDecisions() // so that newly revoked tokens aren't still allowed
+	logger.Log("INFO", "fetched %d revoked subjects and %d revoked token IDs from url:%s", len(list.Subjects), len(list.IDs), plugin.revocationURL)
+}
+
+// checkRevoked returns an error if the token's sub or jti has been revoked, or if the revocation list is unavailable
+// and revocationFailOpen isn't set.
+func (plugin *JWTPlugin) checkRevoked(claims jwt.MapClaims) error {
+	if plugin.revocations == nil {
+		return nil
+	}
+	plugin.revocations.lock.RLock()
+	defer plugin.revocations.lock.RUnlock()
+	if plugin.revocations.failed && !plugin.revocationFailOpen {
+		return errRevocationsUnavailable
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		if _, revoked := plugin.revocations.subjects[sub]; revoked {
+			return errTokenRevoked
+		}
+	}
+	if jti, ok := claims["jti"].(string); ok {
+		if _, revoked := plugin.revocations.ids[jti]; revoked {
+			return errTokenRevoked
+		}
+	}
+	return nil
+}
+
+// newStringSet returns a set of the given values.
+func newStringSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,125 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/danwakefield/fnmatch"
+)
+
+// routeRequirement is an entry of routeRequire: a requirement that applies to requests matching its paths and methods,
+// in addition to the global require or, if replace is set, instead of it.
+type routeRequirement struct {
+	paths       []string           // Path globs, any of which the request must match, or empty for any path
+	methods     CaseInsensitiveSet // The methods one of which the request must have, or empty for any method
+	requirement Requirement
+	replace     bool
+}
+
+// parseRouteRequire parses the routeRequire configuration, a list of maps each with paths and/or methods to match,
+// a require block in the same form as require and an optional replace flag. It panics if a require block is invalid,
+// as NewRequirement does for require.
+func parseRouteRequire(raw []any, optional []string) ([]routeRequirement, error) {
+	routes := make([]routeRequirement, 0, len(raw))
+	for index, entry := range raw {
+		value, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("routeRequire entry %d must be a map", index)
+		}
+		paths, err := stringList(value["paths"])
+		if err != nil {
+			return nil, fmt.Errorf("routeRequire entry %d paths %v", index, err)
+		}
+		methods, err := stringList(value["methods"])
+		if err != nil {
+			return nil, fmt.Errorf("routeRequire entry %d methods %v", index, err)
+		}
+		if len(paths) == 0 && len(methods) == 0 {
+			return nil, fmt.Errorf("routeRequire entry %d must have paths or methods", index)
+		}
+		require, ok := value["require"].(map[string]any)
+		if !ok || len(require) == 0 {
+			// An empty block would add nothing, or with replace, allow any validly signed token
+			return nil, fmt.Errorf("routeRequire entry %d must have a non-empty require", index)
+		}
+		replace, ok := value["replace"].(bool)
+		if !ok && value["replace"] != nil {
+			return nil, fmt.Errorf("routeRequire entry %d replace must be a boolean", index)
+		}
+		routes = append(routes, routeRequirement{
+			paths:       paths,
+			methods:     NewCaseInsensitiveSet(methods),
+			requirement: MakeOptional(NewRequirement(require, "$and"), optional),
+			replace:     replace,
+		})
+	}
+	return routes, nil
+}
+
+// stringList returns the value, which may be absent, as a list of strings.
+func stringList(value any) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("must be a list of strings")
+	}
+	result := make([]string, len(list))
+	for index, item := range list {
+		result[index], ok = item.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a list of strings")
+		}
+	}
+	return result, nil
+}
+
+// requestTarget returns the method and decoded path of the request being authorized. In forwardAuthMode the request is
+// traefik's auth request, so these are taken from the X-Forwarded-Method and X-Forwarded-Uri headers traefik sets for
+// the original request.
+func (plugin *JWTPlugin) requestTarget(request *http.Request) (string, string) {
+	if !plugin.forwardAuthMode {
+		return request.Method, request.URL.Path
+	}
+	method, path := request.Header.Get("X-Forwarded-Method"), ""
+	forwarded, err := url.ParseRequestURI(request.Header.Get("X-Forwarded-Uri"))
+	if err == nil {
+		path = forwarded.Path
+	}
+	return method, path
+}
+
+// matches returns true if the method and path match the route's paths and methods.
+func (route routeRequirement) matches(method string, path string) bool {
+	if len(route.methods) != 0 && !route.methods.Contains(method) {
+		return false
+	}
+	if len(route.paths) == 0 {
+		return true
+	}
+	for _, pattern := range route.paths {
+		if fnmatch.Match(pattern, path, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// requirementFor returns the Requirement for the request: the global requirement, combined with that of the first
+// matching routeRequire entry, which must also be satisfied, or replaced by it if the entry has replace set.
+func (plugin *JWTPlugin) requirementFor(request *http.Request) Requirement {
+	requirement := plugin.requirement()
+	method, path := plugin.requestTarget(request)
+	for _, route := range plugin.routeRequire {
+		if !route.matches(method, path) {
+			continue
+		}
+		if route.replace {
+			return route.requirement
+		}
+		return AndRequirement{requirements: []Requirement{requirement, route.requirement}}
+	}
+	return requirement
+}
@@ -0,0 +1,83 @@
+package jwt_middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tracer starts spans for tracing, so that validation appears in end-to-end traces. It is a minimal interface, readily
+// adapted to OpenTelemetry, Datadog or similar, which may be set with SetTracer when embedding the plugin as a library,
+// without the plugin depending on any of them. There is no tracing unless a Tracer is set.
+type Tracer interface {
+	// Start starts a span with the given name as a child of any span in ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value any)
+	End()
+}
+
+// validationSpanName is the name of the span covering the validation of a request.
+const validationSpanName = "jwt-middleware.validate"
+
+// SetTracer sets the tracer of validation spans, or disables tracing if tracer is nil.
+func (plugin *JWTPlugin) SetTracer(tracer Tracer) {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	plugin.tracer = tracer
+}
+
+// Tracer returns the tracer of validation spans, or nil if there is none.
+func (plugin *JWTPlugin) Tracer() Tracer {
+	plugin.lock.RLock()
+	defer plugin.lock.RUnlock()
+	return plugin.tracer
+}
+
+// startValidationSpan starts a validation span for the request if there is a tracer, returning a function that ends it
+// with the outcome, or nil if there is no tracer.
+func (plugin *JWTPlugin) startValidationSpan(ctx context.Context, variables *TemplateVariables) func(status int, err error) {
+	tracer := plugin.Tracer()
+	if tracer == nil {
+		return nil
+	}
+	(*variables)["traced"] = "true"
+	_, span := tracer.Start(ctx, validationSpanName)
+	start := time.Now()
+	return func(status int, err error) {
+		if issuer := (*variables)["tokenIssuer"]; issuer != "" {
+			span.SetAttribute("jwt.issuer", issuer)
+		}
+		if kid := (*variables)["tokenKid"]; kid != "" {
+			span.SetAttribute("jwt.kid", kid)
+		}
+		span.SetAttribute("jwt.status", status)
+		if err == nil {
+			span.SetAttribute("jwt.decision", "allow")
+		} else {
+			span.SetAttribute("jwt.decision", "deny")
+			span.SetAttribute("jwt.reason", denialReason(err))
+		}
+		span.SetAttribute("jwt.duration_ms", float64(time.Since(start).Microseconds())/1000)
+		span.End()
+	}
+}
+
+// traceToken records the token's iss and kid for the validation span, if the request is being traced.
+func traceToken(token *jwt.Token, variables *TemplateVariables) {
+	if _, traced := (*variables)["traced"]; !traced || token == nil {
+		return
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if issuer, ok := claims["iss"].(string); ok {
+			(*variables)["tokenIssuer"] = issuer
+		}
+	}
+	if kid, ok := keyID(token.Header["kid"]); ok {
+		(*variables)["tokenKid"] = kid
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/agilezebra/jwt-middleware/logger"
 	"github.com/danwakefield/fnmatch"
 )
 
@@ -40,8 +40,64 @@ type AndRequirement struct {
 	requirements []Requirement
 }
 
+// AffixRequirement is a requirement for a string claim that must start with, or if suffix is set end with, any of the affixes.
+type AffixRequirement struct {
+	affixes []string
+	suffix  bool
+}
+
+// OptionalRequirement is a requirement for a claim that is allowed to be absent, but must otherwise be met.
+type OptionalRequirement struct {
+	Requirement
+}
+
+// MessageRequirement is a requirement with a custom message, from $message, that is reported in place of the usual
+// error and denial reason when it isn't met.
+type MessageRequirement struct {
+	Requirement
+	message string
+}
+
+// RequestRequirement is a requirement for an attribute of the request, such as its path, rather than a claim,
+// from a $request. key (e.g. $request.path), which must match any of the patterns, if there are any, and none of the excluded.
+type RequestRequirement struct {
+	attribute string   // The attribute's name in the configuration, e.g. path
+	patterns  []string // Globs, as the request's attributes are given by the client and so can't be trusted as wildcards as claims are
+	excluded  []string // Globs given with a leading !, which the attribute mustn't match
+}
+
+// ClaimRequirement is a requirement for a claim to equal another claim of the same token, named by claim.
+type ClaimRequirement struct {
+	claim string
+}
+
+// RangeRequirement is a requirement for a numeric claim that must fall between min and max.
+// The bounds are included unless exclusive is set.
+type RangeRequirement struct {
+	min       float64
+	max       float64
+	exclusive bool
+}
+
 // NewRequirement is the entry point for creating a new Requirement from the require map.
 func NewRequirement(value any, group string) Requirement {
+	if group == "$prefix" || group == "$suffix" {
+		return NewAffixRequirement(value, group == "$suffix")
+	}
+	if group == "$claim" {
+		claim, ok := value.(string)
+		if !ok || claim == "" {
+			panic(fmt.Sprintf("$claim requires the name of a claim; got %T %v", value, value))
+		}
+		return ClaimRequirement{claim: claim}
+	}
+	if group == "$between" || group == "$betweenExclusive" {
+		bounds, ok := value.([]any)
+		if !ok {
+			panic(fmt.Sprintf("$between requires [min, max]; got %v", value))
+		}
+		return NewRangeRequirement(bounds, group == "$betweenExclusive")
+	}
 	switch value := value.(type) {
 	case []any:
 		requirements := make([]Requirement, len(value))
@@ -51,24 +107,38 @@ func NewRequirement(value any, group string) Requirement {
 		switch group {
 		case "$or":
 			return OrRequirement{requirements: requirements}
-		case "$and":
+		case "$and", "$all":
 			return AndRequirement{requirements: requirements}
 		default:
 			panic(fmt.Sprintf("unknown group: %s", group))
 		}
 	case map[string]any:
+		if message, ok := value["$message"]; ok {
+			return NewMessageRequirement(value, message, group)
+		}
 		if len(value) == 1 {
 			for key, value := range value {
-				if strings.HasPrefix(key, "$") {
+				if strings.HasPrefix(key, "$") && !strings.HasPrefix(key, requestPrefix) {
 					// special case of 1 element maps with a leading $
 					return NewRequirement(value, key)
 				}
 			}
 		}
 
+		// Operators alongside claims (e.g. a top-level $all) must hold as well as the claims
 		result := make(RequirementMap, len(value))
+		var operators []Requirement
 		for claim, value := range value {
-			result[claim] = NewRequirement(value, "$or")
+			if strings.HasPrefix(claim, requestPrefix) {
+				operators = append(operators, NewRequestRequirement(strings.TrimPrefix(claim, requestPrefix), value))
+			} else if strings.HasPrefix(claim, "$") {
+				operators = append(operators, NewRequirement(value, claim))
+			} else {
+				result[claim] = NewRequirement(value, "$or")
+			}
+		}
+		if len(operators) > 0 {
+			return AndRequirement{requirements: append(operators, result)}
 		}
 		return result
 	case string:
@@ -81,6 +151,211 @@ func NewRequirement(value any, group string) Requirement {
 	return ValueRequirement{value: value}
 }
 
+// NewRangeRequirement creates a RangeRequirement from a [min, max] pair, panicking on bad configuration as NewRequirement does.
+func NewRangeRequirement(bounds []any, exclusive bool) Requirement {
+	if len(bounds) != 2 {
+		panic(fmt.Sprintf("$between requires [min, max]; got %v", bounds))
+	}
+	min, ok := requirementNumber(bounds[0])
+	if !ok {
+		panic(fmt.Sprintf("$between min must be a number; got %T %v", bounds[0], bounds[0]))
+	}
+	max, ok := requirementNumber(bounds[1])
+	if !ok {
+		panic(fmt.Sprintf("$between max must be a number; got %T %v", bounds[1], bounds[1]))
+	}
+	if min > max {
+		panic(fmt.Sprintf("$between min %v is greater than max %v", min, max))
+	}
+	return RangeRequirement{min: min, max: max, exclusive: exclusive}
+}
+
+// requestPrefix prefixes the keys of requirements for attributes of the request rather than claims.
+const requestPrefix = "$request."
+
+// requestAttributes are the request attributes that may be required. Their values are passed to Validate in the
+// variables with the requestPrefix, which, unlike the template variables, can't be set from the environment or a claim.
+var requestAttributes = map[string]bool{
+	"method": true,
+	"host":   true,
+	"path":   true,
+	"scheme": true,
+	"url":    true,
+}
+
+// NewRequestRequirement creates a RequestRequirement for the named attribute from a glob or a list of globs, any of which
+// may match, or which mustn't match if given with a leading !, panicking on bad configuration as NewRequirement does.
+func NewRequestRequirement(attribute string, value any) Requirement {
+	if _, ok := requestAttributes[attribute]; !ok {
+		panic(fmt.Sprintf("unknown request attribute %s; expected method, host, path, scheme or url", attribute))
+	}
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	requirement := RequestRequirement{attribute: attribute}
+	for _, value := range values {
+		pattern, ok := value.(string)
+		if !ok || pattern == "" || pattern == "!" {
+			panic(fmt.Sprintf("%s%s requires a non-empty string or list of strings; got %T %v", requestPrefix, attribute, value, value))
+		}
+		if excluded, ok := strings.CutPrefix(pattern, "!"); ok {
+			requirement.excluded = append(requirement.excluded, excluded)
+		} else {
+			requirement.patterns = append(requirement.patterns, pattern)
+		}
+	}
+	return requirement
+}
+
+// NewMessageRequirement creates a MessageRequirement from a map of $message alongside the requirement itself (e.g. $or),
+// panicking on bad configuration as NewRequirement does.
+func NewMessageRequirement(value map[string]any, message any, group string) Requirement {
+	text, ok := message.(string)
+	if !ok || text == "" {
+		panic(fmt.Sprintf("$message requires a non-empty string; got %T %v", message, message))
+	}
+	rest := make(map[string]any, len(value)-1)
+	for key, value := range value {
+		if key != "$message" {
+			rest[key] = value
+		}
+	}
+	if len(rest) == 0 {
+		panic(fmt.Sprintf("$message %q requires a requirement alongside it", text))
+	}
+	return MessageRequirement{Requirement: NewRequirement(rest, group), message: text}
+}
+
+// NewAffixRequirement creates an AffixRequirement from a string or a list of strings, any of which may match,
+// panicking on bad configuration as NewRequirement does.
+func NewAffixRequirement(value any, suffix bool) Requirement {
+	operator := "$prefix"
+	if suffix {
+		operator = "$suffix"
+	}
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	affixes := make([]string, len(values))
+	for index, value := range values {
+		affix, ok := value.(string)
+		if !ok || affix == "" {
+			panic(fmt.Sprintf("%s requires a non-empty string or list of strings; got %T %v", operator, value, value))
+		}
+		affixes[index] = affix
+	}
+	return AffixRequirement{affixes: affixes, suffix: suffix}
+}
+
+// requirementNumber converts a numeric value from the configuration to a float64.
+func requirementNumber(value any) (float64, bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	case json.Number:
+		converted, err := value.Float64()
+		return converted, err == nil
+	}
+	return 0, false
+}
+
+// MakeOptional returns the requirement with the named claims of its top-level RequirementMaps, including those combined
+// by AndRequirement, made OptionalRequirements. Claims in nested maps are unaffected.
+func MakeOptional(requirement Requirement, claims []string) Requirement {
+	if len(claims) == 0 {
+		return requirement
+	}
+	switch requirement := requirement.(type) {
+	case RequirementMap:
+		for _, claim := range claims {
+			if validator, ok := requirement[claim]; ok {
+				requirement[claim] = OptionalRequirement{validator}
+			}
+		}
+	case AndRequirement:
+		for index, nested := range requirement.requirements {
+			requirement.requirements[index] = MakeOptional(nested, claims)
+		}
+	}
+	return requirement
+}
+
+// claimReferencePrefix prefixes the names of the template variables holding the values of claims referenced by ClaimRequirements.
+const claimReferencePrefix = "claim:"
+
+// usesTemplates returns true if the requirement, or any nested within it, is a TemplateRequirement, which needs the
+// environment variables and per-request values to be interpolated.
+func usesTemplates(requirement Requirement) bool {
+	switch requirement := requirement.(type) {
+	case TemplateRequirement:
+		return true
+	case RequirementMap:
+		for _, nested := range requirement {
+			if usesTemplates(nested) {
+				return true
+			}
+		}
+	case OptionalRequirement:
+		return usesTemplates(requirement.Requirement)
+	case MessageRequirement:
+		return usesTemplates(requirement.Requirement)
+	case OrRequirement:
+		for _, nested := range requirement.requirements {
+			if usesTemplates(nested) {
+				return true
+			}
+		}
+	case AndRequirement:
+		for _, nested := range requirement.requirements {
+			if usesTemplates(nested) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setClaimReferences sets the JSON encoded value of each claim referenced by a ClaimRequirement within the requirement
+// in variables, as the requirements are otherwise only given the value of the claim that they apply to.
+func setClaimReferences(requirement Requirement, claims map[string]any, variables *TemplateVariables) {
+	switch requirement := requirement.(type) {
+	case ClaimRequirement:
+		value, ok := claims[requirement.claim]
+		if strings.HasPrefix(requirement.claim, "/") {
+			value, ok = resolvePointer(claims, requirement.claim)
+		}
+		if !ok {
+			return
+		}
+		encoded, err := json.Marshal(value)
+		if err == nil {
+			(*variables)[claimReferencePrefix+requirement.claim] = string(encoded)
+		}
+	case RequirementMap:
+		for _, nested := range requirement {
+			setClaimReferences(nested, claims, variables)
+		}
+	case OptionalRequirement:
+		setClaimReferences(requirement.Requirement, claims, variables)
+	case MessageRequirement:
+		setClaimReferences(requirement.Requirement, claims, variables)
+	case OrRequirement:
+		for _, nested := range requirement.requirements {
+			setClaimReferences(nested, claims, variables)
+		}
+	case AndRequirement:
+		for _, nested := range requirement.requirements {
+			setClaimReferences(nested, claims, variables)
+		}
+	}
+}
+
 // (RequirementMap) Validate is the entry point for validating a JWT claims map (which should be passed in converted to a map[string]any).
 // It will also be called recursively for nested maps within.
 func (requirements RequirementMap) Validate(value any, variables *TemplateVariables) error {
@@ -89,34 +364,128 @@ func (requirements RequirementMap) Validate(value any, variables *TemplateVariab
 		return fmt.Errorf("value must be map[string]any; got %T", value)
 	}
 
+	// Normally the first failure is returned, but every claim is evaluated if all failures are to be reported
+	_, reportAll := (*variables)["reportAllFailures"]
+	var failures failureCollector
+
 outer:
 	for claim, validator := range requirements {
 		value, ok := claims[claim]
+		if strings.HasPrefix(claim, "/") {
+			// A JSON Pointer, which unambiguously addresses nested values, even in arrays or with keys containing dots
+			value, ok = resolvePointer(claims, claim)
+		}
 		if ok {
 			// Claim is present, simply validate it
 			err := validator.Validate(value, variables)
 			if err != nil {
-				return fmt.Errorf("%s: %w", claim, err)
+				if expected, mismatched := mismatchedType(validator, value); mismatched {
+					requestLog(variables, "DEBUG", "claim %s: requirement of type %s can never match claim of type %T\n", claim, expected, value)
+				}
+				failure := fmt.Errorf("%s: %w", claim, err)
+				if !reportAll {
+					return failure
+				}
+				failures.add(failure)
 			}
 		} else {
 			// Claim is not present, but a wildcard claim may match
 			err := fmt.Errorf("claim is not present")
+			matched := false
 			for pattern, value := range claims {
 				if wildcardMatch(pattern, claim) {
 					err := validator.Validate(value, variables)
 					if err == nil {
 						continue outer
 					}
+					matched = true
 				}
 			}
+			if _, optional := validator.(OptionalRequirement); optional && !matched {
+				continue
+			}
 
 			// Claim is not present and no wildcard match found, or a wildcard matched but claim is not valid
-			return fmt.Errorf("%s: %w", claim, err)
+			failure := fmt.Errorf("%s: %w", claim, withMessage(validator, err))
+			if !reportAll {
+				return failure
+			}
+			failures.add(failure)
 		}
 	}
 
-	// All claims were validated successfully
-	return nil
+	// nil if all claims were validated successfully
+	return failures.err()
+}
+
+// requirementFailures is the error for more than one failed requirement when all failures are reported.
+type requirementFailures []string
+
+func (failures requirementFailures) Error() string {
+	return fmt.Sprintf("%d requirements failed: %s", len(failures), strings.Join(failures, "; "))
+}
+
+// failureCollector gathers the failures of requirements when all failures are to be reported, flattening those of
+// nested $and and $or requirements so that every failure is listed once, whichever requirement found it.
+type failureCollector struct {
+	failures []string
+	failure  error // The last failure, which is the only one if there is one
+}
+
+// add adds the failure, or each of the failures if it is a requirementFailures, unless already present.
+func (collector *failureCollector) add(failure error) {
+	failures, ok := failure.(requirementFailures)
+	if !ok {
+		failures = requirementFailures{failure.Error()}
+	}
+outer:
+	for _, message := range failures {
+		for _, existing := range collector.failures {
+			if existing == message {
+				continue outer
+			}
+		}
+		collector.failures = append(collector.failures, message)
+	}
+	collector.failure = failure
+}
+
+// err returns the failure if there was only one, all of them if there were more, or nil if there were none.
+func (collector *failureCollector) err() error {
+	switch len(collector.failures) {
+	case 0:
+		return nil
+	case 1:
+		return collector.failure
+	}
+	// Sorted so that the same failures are always reported alike, whatever the map's iteration order
+	sort.Strings(collector.failures)
+	return requirementFailures(collector.failures)
+}
+
+// resolvePointer returns the value addressed by the RFC 6901 JSON Pointer within the document, and whether it is present.
+func resolvePointer(document any, pointer string) (any, bool) {
+	for _, token := range strings.Split(pointer, "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch value := document.(type) {
+		case map[string]any:
+			var ok bool
+			document, ok = value[token]
+			if !ok {
+				return nil, false
+			}
+		case []any:
+			// Indices must be plain decimal numbers without leading zeros, so "-" (past the end) and "+1" address nothing
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) || token != strconv.Itoa(index) {
+				return nil, false
+			}
+			document = value[index]
+		default:
+			return nil, false
+		}
+	}
+	return document, true
 }
 
 // (ValueRequirement)Validate checks value against the requirement, calling back to itself recursively for object and array values.
@@ -142,13 +511,31 @@ func (requirement ValueRequirement) Validate(value any, variables *TemplateVaria
 			}
 		}
 	case string:
-		required, ok := requirement.value.(string)
-		if ok {
+		switch required := requirement.value.(type) {
+		case string:
 			if wildcardMatch(value, required) {
 				return nil
 			}
 			if verbose {
-				logger.Log(level, "claim is not valid: require:%s got:%v", required, value)
+				requestLog(variables, level, "claim is not valid: require:%s got:%v", required, value)
+			}
+		case bool:
+			// Some providers send boolean claims as strings, which match only if coerceBooleans is set
+			if _, coerce := (*variables)["coerceBooleans"]; coerce && value == strconv.FormatBool(required) {
+				return nil
+			}
+			if verbose {
+				requestLog(variables, level, "claim is not valid: require:%t got:%q", required, value)
+			}
+		}
+	case bool:
+		required, ok := requirement.value.(bool)
+		if ok {
+			if value == required {
+				return nil
+			}
+			if verbose {
+				requestLog(variables, level, "claim is not valid: require:%t got:%t", required, value)
 			}
 		}
 	case json.Number:
@@ -160,7 +547,7 @@ func (requirement ValueRequirement) Validate(value any, variables *TemplateVaria
 				return nil
 			}
 			if verbose {
-				logger.Log(level, "claim is not valid: require:%d got:%v", required, value)
+				requestLog(variables, level, "claim is not valid: require:%d got:%v", required, value)
 			}
 		case float64:
 			converted, err := value.Float64()
@@ -169,10 +556,15 @@ func (requirement ValueRequirement) Validate(value any, variables *TemplateVaria
 				return nil
 			}
 			if verbose {
-				logger.Log(level, "claim is not valid: require:%f got:%v", required, value)
+				requestLog(variables, level, "claim is not valid: require:%f got:%v", required, value)
+			}
+		case bool:
+			// A numeric claim never matches a boolean requirement, but that's the token's claim not matching rather than our error
+			if verbose {
+				requestLog(variables, level, "claim is not valid: require:%t got:%v", requirement.value, value)
 			}
 		default:
-			log.Printf("unsupported requirement type for json.Number comparison: %T %v", requirement.value, requirement.value)
+			requestLog(variables, "ERROR", "unsupported requirement type for json.Number comparison: %T %v", requirement.value, requirement.value)
 			return fmt.Errorf("unsupported requirement type for json.Number comparison")
 		}
 	}
@@ -185,31 +577,271 @@ func (requirement TemplateRequirement) Validate(value any, variables *TemplateVa
 	var buffer bytes.Buffer
 	err := requirement.template.Execute(&buffer, variables)
 	if err != nil {
-		log.Printf("Error executing template: %s", err)
+		requestLog(variables, "ERROR", "Error executing template: %s", err)
 		return fmt.Errorf("claim is not valid") // return a generic error to avoid leaking information about the template
 	}
 	return ValueRequirement{value: buffer.String()}.Validate(value, variables)
 }
 
 // (OrRequirement) Validate checks if any of the values in the OR list match wth the value
+// If all failures are to be reported, those of every alternative are returned when none matches.
 func (requirement OrRequirement) Validate(value any, variables *TemplateVariables) error {
+	_, reportAll := (*variables)["reportAllFailures"]
+	var failures failureCollector
 	for _, requirement := range requirement.requirements {
 		err := requirement.Validate(value, variables)
 		if err == nil {
 			return err
 		}
+		if reportAll {
+			failures.add(err)
+		}
+	}
+	if reportAll && len(failures.failures) != 0 {
+		return failures.err()
 	}
 	return fmt.Errorf("claim is not valid")
 }
 
+// (RangeRequirement) Validate checks that the value, or any value in an array, is a number within the range.
+func (requirement RangeRequirement) Validate(value any, variables *TemplateVariables) error {
+	switch value := value.(type) {
+	case []any:
+		for _, value := range value {
+			err := requirement.Validate(value, variables)
+			if err == nil {
+				return nil
+			}
+		}
+	case json.Number:
+		converted, err := value.Float64()
+		if err == nil && requirement.contains(converted) {
+			return nil
+		}
+	}
+
+	if level, verbose := (*variables)["logUnauthorized"]; verbose {
+		requestLog(variables, level, "claim is not valid: require between:%v and %v got:%v", requirement.min, requirement.max, value)
+	}
+	return fmt.Errorf("claim is not valid")
+}
+
+// (AffixRequirement) Validate checks that the value, or any value in an array, is a string with one of the affixes.
+func (requirement AffixRequirement) Validate(value any, variables *TemplateVariables) error {
+	switch value := value.(type) {
+	case []any:
+		for _, value := range value {
+			err := requirement.Validate(value, variables)
+			if err == nil {
+				return nil
+			}
+		}
+	case string:
+		for _, affix := range requirement.affixes {
+			if (!requirement.suffix && strings.HasPrefix(value, affix)) || (requirement.suffix && strings.HasSuffix(value, affix)) {
+				return nil
+			}
+		}
+	}
+
+	if level, verbose := (*variables)["logUnauthorized"]; verbose {
+		kind := "prefix"
+		if requirement.suffix {
+			kind = "suffix"
+		}
+		requestLog(variables, level, "claim is not valid: require %s:%v got:%v", kind, requirement.affixes, value)
+	}
+	return fmt.Errorf("claim is not valid")
+}
+
+// (ClaimRequirement) Validate checks that the value, or any value in an array, equals the referenced claim,
+// which must be present. Values are compared by their JSON encoding, so that, for example, numbers compare exactly.
+func (requirement ClaimRequirement) Validate(value any, variables *TemplateVariables) error {
+	referenced, ok := (*variables)[claimReferencePrefix+requirement.claim]
+	if ok {
+		candidates := []any{value}
+		if values, isArray := value.([]any); isArray {
+			candidates = append(candidates, values...)
+		}
+		for _, value := range candidates {
+			encoded, err := json.Marshal(value)
+			if err == nil && string(encoded) == referenced {
+				return nil
+			}
+		}
+	}
+
+	if level, verbose := (*variables)["logUnauthorized"]; verbose {
+		requestLog(variables, level, "claim is not valid: require claim %s:%s got:%v", requirement.claim, referenced, value)
+	}
+	return fmt.Errorf("claim is not valid")
+}
+
+// contains returns true if the number is within the range.
+func (requirement RangeRequirement) contains(number float64) bool {
+	if requirement.exclusive {
+		return number > requirement.min && number < requirement.max
+	}
+	return number >= requirement.min && number <= requirement.max
+}
+
+// Validate checks the value against the requirement, reporting its message if it isn't met.
+func (requirement MessageRequirement) Validate(value any, variables *TemplateVariables) error {
+	err := requirement.Requirement.Validate(value, variables)
+	if err != nil {
+		return messageError{message: requirement.message, err: err}
+	}
+	return nil
+}
+
+// Validate checks the request attribute, set in the variables by setRequestAttributes, against the patterns, ignoring
+// the value.
+func (requirement RequestRequirement) Validate(_ any, variables *TemplateVariables) error {
+	value := (*variables)[requestPrefix+requirement.attribute]
+	if requirement.matches(value) {
+		return nil
+	}
+	if level, verbose := (*variables)["logUnauthorized"]; verbose {
+		requestLog(variables, level, "request is not valid: require %s:%v excluding:%v got:%s", requirement.attribute, requirement.patterns, requirement.excluded, value)
+	}
+	return fmt.Errorf("%s%s: request is not valid", requestPrefix, requirement.attribute)
+}
+
+// matches returns true if the value matches any of the patterns, or there are none, and none of the excluded patterns.
+func (requirement RequestRequirement) matches(value string) bool {
+	for _, pattern := range requirement.excluded {
+		if fnmatch.Match(pattern, value, 0) {
+			return false
+		}
+	}
+	if len(requirement.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range requirement.patterns {
+		if fnmatch.Match(pattern, value, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// withMessage returns err as the failure of the requirement, with the requirement's message, if it has one.
+func withMessage(requirement Requirement, err error) error {
+	if optional, ok := requirement.(OptionalRequirement); ok {
+		requirement = optional.Requirement
+	}
+	if message, ok := requirement.(MessageRequirement); ok {
+		return messageError{message: message.message, err: err}
+	}
+	return err
+}
+
+// messageError is the failure of a MessageRequirement, which is reported with its message.
+type messageError struct {
+	message string
+	err     error
+}
+
+func (err messageError) Error() string {
+	return err.message
+}
+
+func (err messageError) Unwrap() error {
+	return err.err
+}
+
 func (requirement AndRequirement) Validate(value any, variables *TemplateVariables) error {
+	// Normally the first failure is returned, but every requirement is evaluated if all failures are to be reported
+	_, reportAll := (*variables)["reportAllFailures"]
+	var failures failureCollector
 	for _, requirement := range requirement.requirements {
 		err := requirement.Validate(value, variables)
 		if err != nil {
-			return err
+			if !reportAll {
+				return err
+			}
+			failures.add(err)
 		}
 	}
-	return nil
+	return failures.err()
+}
+
+// mismatchedType returns the type expected by the requirement, and true, if no value of the claim's type could ever satisfy it,
+// which most likely indicates a mistake in the configuration.
+func mismatchedType(requirement Requirement, value any) (string, bool) {
+	if values, ok := value.([]any); ok {
+		// Each value in an array claim is tried against the requirement
+		for _, value := range values {
+			if _, mismatched := mismatchedType(requirement, value); !mismatched {
+				return "", false
+			}
+		}
+		if len(values) > 0 {
+			return mismatchedType(requirement, values[0])
+		}
+		return "", false
+	}
+
+	switch requirement := requirement.(type) {
+	case ValueRequirement:
+		expected := fmt.Sprintf("%T", requirement.value)
+		switch requirement.value.(type) {
+		case string:
+			switch value.(type) {
+			case string, map[string]any:
+				return expected, false
+			}
+		case bool:
+			switch value.(type) {
+			case bool, string:
+				return expected, false
+			}
+		case int, float64:
+			if _, ok := value.(json.Number); ok {
+				return expected, false
+			}
+		}
+		return expected, true
+	case TemplateRequirement:
+		switch value.(type) {
+		case string, map[string]any:
+			return "string", false
+		}
+		return "string", true
+	case RangeRequirement:
+		_, ok := value.(json.Number)
+		return "number", !ok
+	case AffixRequirement:
+		_, ok := value.(string)
+		return "string", !ok
+	case RequirementMap:
+		_, ok := value.(map[string]any)
+		return "map[string]interface {}", !ok
+	case OptionalRequirement:
+		return mismatchedType(requirement.Requirement, value)
+	case MessageRequirement:
+		return mismatchedType(requirement.Requirement, value)
+	case OrRequirement:
+		return mismatchedTypes(requirement.requirements, value)
+	case AndRequirement:
+		return mismatchedTypes(requirement.requirements, value)
+	}
+	return "", false
+}
+
+// mismatchedTypes returns the first expected type, and true, if none of the requirements could match a value of the claim's type.
+func mismatchedTypes(requirements []Requirement, value any) (string, bool) {
+	expected := ""
+	for _, requirement := range requirements {
+		found, mismatched := mismatchedType(requirement, value)
+		if !mismatched {
+			return "", false
+		}
+		if expected == "" {
+			expected = found
+		}
+	}
+	return expected, len(requirements) > 0
 }
 
 // wildcardMatch checks if the claim pattern (which may contain wildcards) matches the required string
@@ -3,6 +3,7 @@
 package jwt_middleware
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -27,3 +28,84 @@ func TestValidatorMap(tester *testing.T) {
 		tester.Fatalf("RequirementMap.Validate() = %v; want error", result)
 	}
 }
+
+func TestNewRangeRequirement(tester *testing.T) {
+	tests := []struct {
+		name   string
+		bounds any
+		group  string
+	}{
+		{"too few bounds", []any{1}, "$between"},
+		{"non-numeric bound", []any{1, "five"}, "$between"},
+		{"min greater than max", []any{5, 1}, "$between"},
+		{"scalar", 5, "$between"},
+		{"scalar exclusive", 5, "$betweenExclusive"},
+		{"map", map[string]any{"min": 1, "max": 5}, "$between"},
+	}
+	for _, test := range tests {
+		tester.Run(test.name, func(tester *testing.T) {
+			defer func() {
+				if recover() == nil {
+					tester.Fatal("NewRequirement() did not panic")
+				}
+			}()
+			NewRequirement(test.bounds, test.group)
+		})
+	}
+}
+
+func TestNewAffixRequirement(tester *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{"non-string", 1},
+		{"empty string", ""},
+		{"non-string in list", []any{"CN=Admins,", 1}},
+	}
+	for _, test := range tests {
+		tester.Run(test.name, func(tester *testing.T) {
+			defer func() {
+				if recover() == nil {
+					tester.Fatal("NewRequirement() did not panic")
+				}
+			}()
+			NewRequirement(test.value, "$prefix")
+		})
+	}
+}
+
+func TestResolvePointer(tester *testing.T) {
+	document := map[string]any{"a": []any{"x", "y"}, "a/b": "slash", "m~n": "tilde", "": "empty"}
+	tests := map[string]any{
+		"/a/1":   "y",
+		"/a~1b":  "slash",
+		"/m~0n":  "tilde",
+		"/":      "empty",
+		"/a/01":  nil,
+		"/a/-":   nil,
+		"/a/+1":  nil,
+		"/a/2":   nil,
+		"/b":     nil,
+		"/a/1/c": nil,
+	}
+	for pointer, expected := range tests {
+		value, ok := resolvePointer(document, pointer)
+		if ok != (expected != nil) || (ok && value != expected) {
+			tester.Errorf("resolvePointer(%q) = %v, %t; expected %v", pointer, value, ok, expected)
+		}
+	}
+}
+
+func TestNewClaimRequirement(tester *testing.T) {
+	for _, value := range []any{1, "", []any{"org_id"}} {
+		tester.Run(fmt.Sprint(value), func(tester *testing.T) {
+			defer func() {
+				if recover() == nil {
+					tester.Fatal("NewRequirement() did not panic")
+				}
+			}()
+			NewRequirement(value, "$claim")
+		})
+	}
+}